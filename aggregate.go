@@ -0,0 +1,255 @@
+package kv2doc
+
+import (
+	"strconv"
+	"strings"
+)
+
+// 聚合方式
+const (
+	aggCount = iota
+	aggCountDistinct
+	aggSum
+	aggAvg
+	aggMin
+	aggMax
+)
+
+// Group 分组聚合，由 Query.GroupBy 生成
+type Group struct {
+	query   *Query
+	fields  []string
+	aggs    []aggregator
+	havings []string
+	params  map[string]any
+	err     error
+}
+
+type aggregator struct {
+	operator int
+	field    string
+	as       string
+}
+
+// 单个分组中单个聚合的中间状态
+type accumulator struct {
+	count    int64
+	sum      float64
+	min      string
+	max      string
+	distinct map[string]bool
+}
+
+// GroupBy 按指定字段分组聚合（不传字段时所有文档为一组），复用当前查询的筛选条件及索引
+// 每个分组返回一个文档，包含分组字段及各个聚合结果
+func (c *Query) GroupBy(fields ...string) *Group {
+	return &Group{
+		query:  c,
+		fields: fields,
+	}
+}
+
+// Count 统计分组中的文档数量，结果保存在 as 字段中
+func (c *Group) Count(as string) *Group {
+	return c.aggregate(aggCount, "", as)
+}
+
+// CountDistinct 统计分组中指定字段不同取值的数量
+func (c *Group) CountDistinct(field, as string) *Group {
+	return c.aggregate(aggCountDistinct, field, as)
+}
+
+// Sum 求和，非数字的字段值不参与计算
+func (c *Group) Sum(field, as string) *Group {
+	return c.aggregate(aggSum, field, as)
+}
+
+// Avg 求平均值，非数字的字段值不参与计算
+func (c *Group) Avg(field, as string) *Group {
+	return c.aggregate(aggAvg, field, as)
+}
+
+// Min 最小值，字段值都是数字时按数字比较，否则按字符串比较
+func (c *Group) Min(field, as string) *Group {
+	return c.aggregate(aggMin, field, as)
+}
+
+// Max 最大值，字段值都是数字时按数字比较，否则按字符串比较
+func (c *Group) Max(field, as string) *Group {
+	return c.aggregate(aggMax, field, as)
+}
+
+// Having 筛选聚合结果，使用 Expr() 构建筛选条件，条件中的字段为分组字段及聚合结果字段
+func (c *Group) Having(sc *Query) *Group {
+	// 多次调用 Having 时各个条件的参数重新编号，避免参数名冲突
+	names := rebind(&c.params, sc.params)
+	for _, v := range sc.clauses {
+		c.havings = append(c.havings, v.rename(names).String())
+	}
+	if c.err == nil {
+		c.err = sc.err
+	}
+	return c
+}
+
+func (c *Group) aggregate(operator int, field, as string) *Group {
+	if len(as) <= 0 {
+		as = field
+	}
+	c.aggs = append(c.aggs, aggregator{
+		operator: operator,
+		field:    field,
+		as:       as,
+	})
+	return c
+}
+
+// List 返回聚合结果，按分组字段值排序
+func (c *Group) List() (docs []Doc, err error) {
+	if c.query.isChild {
+		return nil, nil
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	having, err := getFilter(c.havings, c.params, c.query.parser)
+	if err != nil {
+		return nil, err
+	}
+	cc := *c.query
+	// 只需要读取分组字段和聚合字段，可以走覆盖索引
+	cc.selects = append([]string{}, c.fields...)
+	for _, v := range c.aggs {
+		if len(v.field) > 0 {
+			cc.selects = append(cc.selects, v.field)
+		}
+	}
+	cc.excludes = nil
+	cc.hideInternal = false
+
+	var rows []Doc
+	group := &groupProcessor{
+		fields: c.fields,
+		aggs:   c.aggs,
+		keys:   make(map[string]Doc),
+		states: make(map[string][]*accumulator),
+		next: &collector{
+			docs: &rows,
+		},
+	}
+	// 相似度查询和分页需要先得到完整的查询结果
+	if cc.nearest != nil || cc.limit.enable {
+		_, list, err := query(cc, false)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range list {
+			group.push(v)
+		}
+	} else {
+		err = scan(cc, group.push)
+		if err != nil {
+			return nil, err
+		}
+	}
+	group.flush()
+
+	for _, v := range rows {
+		if having != nil {
+			if match, _ := having(v); !match {
+				continue
+			}
+		}
+		docs = append(docs, v)
+	}
+	return docs, nil
+}
+
+func newAccumulators(n int) []*accumulator {
+	accumulators := make([]*accumulator, n)
+	for i := range accumulators {
+		accumulators[i] = &accumulator{
+			distinct: make(map[string]bool),
+		}
+	}
+	return accumulators
+}
+
+func (c *accumulator) push(agg aggregator, doc Doc) {
+	if agg.operator == aggCount {
+		c.count++
+		return
+	}
+	value := doc[agg.field]
+	if len(value) <= 0 {
+		return
+	}
+	switch agg.operator {
+	case aggCountDistinct:
+		c.distinct[value] = true
+	case aggSum, aggAvg:
+		if f, ok := toDouble(value); ok {
+			c.sum += f
+			c.count++
+		}
+	case aggMin:
+		if c.count <= 0 || less(value, c.min) {
+			c.min = value
+		}
+		c.count++
+	case aggMax:
+		if c.count <= 0 || less(c.max, value) {
+			c.max = value
+		}
+		c.count++
+	}
+}
+
+func (c *accumulator) result(operator int) (string, bool) {
+	switch operator {
+	case aggCount:
+		return strconv.FormatInt(c.count, 10), true
+	case aggCountDistinct:
+		return strconv.Itoa(len(c.distinct)), true
+	case aggSum:
+		return toNumber(c.sum), true
+	case aggAvg:
+		if c.count <= 0 {
+			return "", false
+		}
+		return toNumber(c.sum / float64(c.count)), true
+	case aggMin:
+		return c.min, c.count > 0
+	case aggMax:
+		return c.max, c.count > 0
+	}
+	return "", false
+}
+
+// 比较两个字段值，都是数字时按数字比较，否则按字符串比较
+func less(l, r string) bool {
+	return compare(l, r) < 0
+}
+
+// 比较两个字段值：数字排在非数字之前，数字之间按数值比较，非数字之间按字符串比较
+// 数值相等但写法不同（如 "1" 与 "1.0"）时按原始字符串比较，保证顺序唯一且可传递
+func compare(l, r string) int {
+	ld, lb := toDouble(l)
+	rd, rb := toDouble(r)
+	switch {
+	case lb && !rb:
+		return -1
+	case !lb && rb:
+		return 1
+	case lb && rb && ld != rd:
+		if ld < rd {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(l, r)
+}
+
+func toNumber(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
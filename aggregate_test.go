@@ -0,0 +1,94 @@
+package kv2doc_test
+
+import (
+	"github.com/dpwgc/kv2doc"
+	"reflect"
+	"testing"
+)
+
+func addSales(t *testing.T, db *kv2doc.DB) {
+	t.Helper()
+	addDocs(t, db, "sales",
+		kv2doc.Doc{"region": "east", "product": "tea", "amount": "9"},
+		kv2doc.Doc{"region": "east", "product": "tea", "amount": "10"},
+		kv2doc.Doc{"region": "east", "product": "milk", "amount": "41"},
+		kv2doc.Doc{"region": "west", "product": "tea", "amount": "5.5"},
+		kv2doc.Doc{"region": "west", "product": "coffee", "amount": "unknown"},
+		kv2doc.Doc{"product": "tea", "amount": "100"},
+	)
+}
+
+func TestGroupBy(t *testing.T) {
+	db, _ := newTestDB(t)
+	addSales(t, db)
+
+	tests := []struct {
+		name  string
+		group *kv2doc.Group
+		want  []kv2doc.Doc
+	}{
+		{
+			name: "aggregations",
+			group: db.Query("sales").Exist("region").GroupBy("region").
+				Count("count").CountDistinct("product", "products").Sum("amount", "total").
+				Avg("amount", "avg").Min("amount", "min").Max("amount", "max"),
+			// 数字按数值比较，9 小于 10；非数字的金额不参与求和及平均值
+			want: []kv2doc.Doc{
+				{"region": "east", "count": "3", "products": "2", "total": "60", "avg": "20", "min": "9", "max": "41"},
+				{"region": "west", "count": "2", "products": "2", "total": "5.5", "avg": "5.5", "min": "5.5", "max": "unknown"},
+			},
+		},
+		{
+			name:  "multiple fields",
+			group: db.Query("sales").Eq("product", "tea").GroupBy("region", "product").Count("count"),
+			// 缺少分组字段的文档单独成组
+			want: []kv2doc.Doc{
+				{"region": "", "product": "tea", "count": "1"},
+				{"region": "east", "product": "tea", "count": "2"},
+				{"region": "west", "product": "tea", "count": "1"},
+			},
+		},
+		{
+			name:  "having",
+			group: db.Query("sales").GroupBy("product").Sum("amount", "total").Having(kv2doc.Expr().Gt("total", "30")),
+			want: []kv2doc.Doc{
+				{"product": "milk", "total": "41"},
+				{"product": "tea", "total": "124.5"},
+			},
+		},
+		{
+			// 多个 Having 条件的参数分别编号
+			name: "multiple havings",
+			group: db.Query("sales").GroupBy("product").Sum("amount", "total").
+				Having(kv2doc.Expr().Gt("total", "30")).Having(kv2doc.Expr().Lt("total", "100")),
+			want: []kv2doc.Doc{{"product": "milk", "total": "41"}},
+		},
+		{
+			name:  "no group fields",
+			group: db.Query("sales").GroupBy().Count("count").Max("amount", "max"),
+			want:  []kv2doc.Doc{{"count": "6", "max": "unknown"}},
+		},
+		{
+			// 不分组时，即使没有文档也返回一行
+			name:  "no documents",
+			group: db.Query("sales").Eq("product", "juice").GroupBy().Count("count").Avg("amount", "avg"),
+			want:  []kv2doc.Doc{{"count": "0"}},
+		},
+		{
+			name:  "limit before grouping",
+			group: db.Query("sales").Asc("amount").Limit(0, 2).GroupBy("product").Count("count"),
+			want:  []kv2doc.Doc{{"product": "tea", "count": "2"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.group.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
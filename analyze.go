@@ -0,0 +1,69 @@
+package kv2doc
+
+import (
+	"strings"
+	"time"
+)
+
+// 排序方式
+const (
+	sortNone = "none" // 不排序，按扫描顺序返回
+	sortFull = "sort" // 扫描完成后对全部结果排序
+	sortTopK = "topk" // 相似度查询，扫描时只保留最相似的 k 个文档
+)
+
+// 扫描结束的原因
+const (
+	stopEnd        = "end"         // 扫描完全部候选文档
+	stopLimit      = "limit"       // 取够 Limit 个文档后提前结束
+	stopCanceled   = "canceled"    // ctx 已取消
+	stopTimeout    = "timeout"     // 查询超时
+	stopMaxScanned = "max_scanned" // 超出扫描数量限制
+)
+
+// Analysis 实际执行查询后的统计信息
+type Analysis struct {
+	Explain
+	Keys       int64         // 扫描的 key 数量（索引扫描时为索引 key，全表扫描时为文档 key）
+	Fetched    int64         // 读取的文档数量（覆盖索引不读取文档）
+	Matched    int64         // 满足查询条件的文档数量
+	Returned   int           // 返回的文档数量
+	SortSize   int           // 参与排序的文档数量
+	SortMethod string        // 排序方式：none 不排序，sort 全量排序，topk 只保留最相似的 k 个
+	EarlyStop  bool          // 是否因为 Limit 提前结束了扫描
+	StopReason string        // 结束的原因：end 扫描完全部候选，limit 取够 Limit 个文档，canceled、timeout、max_scanned 为扫描或排序被中断（同时返回错误）
+	PlanTime   time.Duration // 选择访问路径的耗时
+	ScanTime   time.Duration // 扫描及筛选的耗时（包含关联查询）
+	SortTime   time.Duration // 排序的耗时（全量排序或取出最相似的 k 个）
+	TotalTime  time.Duration // 总耗时
+}
+
+// ExplainAnalyze 执行查询并返回执行计划及实际的执行统计（与 List 相同的方式执行，不返回文档）
+func (c *Query) ExplainAnalyze() (Analysis, error) {
+	analysis := Analysis{
+		Explain: Explain{
+			Expr:   strings.Join(c.conditions(), " && "),
+			Params: c.params,
+		},
+		SortMethod: sortNone,
+	}
+	if c.isChild {
+		return analysis, nil
+	}
+	cc := *c
+	cc.stats = &analysis
+	start := time.Now()
+	_, docs, err := query(cc, false)
+	analysis.TotalTime = time.Since(start)
+	if err != nil {
+		return analysis, err
+	}
+	analysis.Returned = len(docs)
+	if len(analysis.StopReason) <= 0 {
+		analysis.StopReason = stopEnd
+	}
+	if len(analysis.Plan.Indexes) > 0 {
+		analysis.Index = analysis.Plan.Indexes[0]
+	}
+	return analysis, nil
+}
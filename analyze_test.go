@@ -0,0 +1,118 @@
+package kv2doc_test
+
+import (
+	"fmt"
+	"github.com/dpwgc/kv2doc"
+	"testing"
+	"time"
+)
+
+func TestExplainAnalyze(t *testing.T) {
+	db, _ := newTestDB(t)
+	if err := db.Define("tickets", kv2doc.Field{Name: "vec", Type: kv2doc.Vector, Dim: 2}); err != nil {
+		t.Fatal(err)
+	}
+	// 30 个工单，其中 n 为 0、10、20 的 3 个是 open
+	for i := 0; i < 30; i++ {
+		status := "done"
+		if i%10 == 0 {
+			status = "open"
+		}
+		addDocs(t, db, "tickets", kv2doc.Doc{"status": status, "n": fmt.Sprint(i), "vec": fmt.Sprintf("[%d,1]", i)})
+	}
+
+	tests := []struct {
+		name  string
+		query *kv2doc.Query
+		check func(t *testing.T, a kv2doc.Analysis)
+	}{
+		{
+			name:  "index",
+			query: db.Query("tickets").Eq("status", "open").Gt("n", "5"),
+			check: func(t *testing.T, a kv2doc.Analysis) {
+				if a.Plan.Access != "index" || a.Index.String() != "f/status/open/" {
+					t.Errorf("Plan = %+v, want an index scan on status", a.Plan)
+				}
+				// 扫描 3 个索引 key，读取 3 个文档，其中 n 为 0 的文档被过滤
+				if a.Keys != 3 || a.Fetched != 3 || a.Matched != 2 || a.Returned != 2 {
+					t.Errorf("Keys, Fetched, Matched, Returned = %d, %d, %d, %d, want 3, 3, 2, 2", a.Keys, a.Fetched, a.Matched, a.Returned)
+				}
+				if a.SortMethod != "none" || a.EarlyStop {
+					t.Errorf("SortMethod = %s, EarlyStop = %v", a.SortMethod, a.EarlyStop)
+				}
+			},
+		},
+		{
+			name:  "early stop",
+			query: db.Query("tickets").Eq("status", "done").Limit(0, 4),
+			check: func(t *testing.T, a kv2doc.Analysis) {
+				if !a.EarlyStop || a.Returned != 4 || a.Keys >= 27 {
+					t.Errorf("EarlyStop = %v, Returned = %d, Keys = %d, want an early stop after 4 documents", a.EarlyStop, a.Returned, a.Keys)
+				}
+			},
+		},
+		{
+			name:  "sort",
+			query: db.Query("tickets").Desc("n").Limit(0, 5),
+			check: func(t *testing.T, a kv2doc.Analysis) {
+				if a.Plan.Access != "scan" || a.Keys != 30 || a.Fetched != 30 {
+					t.Errorf("Plan = %+v, Keys = %d, Fetched = %d, want a full scan", a.Plan, a.Keys, a.Fetched)
+				}
+				// 排序需要全部结果，不能提前结束
+				if a.SortMethod != "sort" || a.SortSize != 30 || a.Returned != 5 || a.EarlyStop {
+					t.Errorf("SortMethod = %s, SortSize = %d, Returned = %d, EarlyStop = %v", a.SortMethod, a.SortSize, a.Returned, a.EarlyStop)
+				}
+			},
+		},
+		{
+			name:  "top k",
+			query: db.Query("tickets").Nearest("vec", []float64{7, 1}, 3, kv2doc.L2),
+			check: func(t *testing.T, a kv2doc.Analysis) {
+				// 30 个文档参与排序，只保留最相似的 3 个
+				if a.SortMethod != "topk" || a.SortSize != 30 || a.Returned != 3 || a.Matched != 30 {
+					t.Errorf("SortMethod = %s, SortSize = %d, Returned = %d, Matched = %d", a.SortMethod, a.SortSize, a.Returned, a.Matched)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			analysis, err := tt.query.ExplainAnalyze()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if analysis.TotalTime <= 0 || analysis.TotalTime < analysis.ScanTime {
+				t.Errorf("TotalTime = %v, ScanTime = %v", analysis.TotalTime, analysis.ScanTime)
+			}
+			tt.check(t, analysis)
+		})
+	}
+
+	// 扫描或排序被中断时，返回错误并记录中断的原因
+	stops := []struct {
+		name  string
+		query *kv2doc.Query
+		want  string
+	}{
+		{"end", db.Query("tickets").Desc("n"), "end"},
+		{"limit", db.Query("tickets").Limit(0, 4), "limit"},
+		{"sort timeout", db.Query("tickets").Desc("n").Timeout(time.Nanosecond), "timeout"},
+		{"top k max scanned", db.Query("tickets").Nearest("vec", []float64{7, 1}, 3, kv2doc.L2).MaxScanned(10), "max_scanned"},
+	}
+	for _, tt := range stops {
+		t.Run(tt.name, func(t *testing.T) {
+			analysis, err := tt.query.ExplainAnalyze()
+			if (err != nil) != (tt.want != "end" && tt.want != "limit") {
+				t.Errorf("ExplainAnalyze() error = %v", err)
+			}
+			if analysis.StopReason != tt.want {
+				t.Errorf("StopReason = %s, want %s", analysis.StopReason, tt.want)
+			}
+		})
+	}
+
+	// 查询出错时同样返回错误
+	if _, err := db.Query("tickets").Regex("n", "(").ExplainAnalyze(); err == nil {
+		t.Error("ExplainAnalyze() with an invalid regex returned no error")
+	}
+}
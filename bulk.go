@@ -1,6 +1,9 @@
 package kv2doc
 
-import "github.com/dpwgc/kv2doc/store"
+import (
+	"context"
+	"github.com/dpwgc/kv2doc/store"
+)
 
 type Bulk struct {
 	db      *DB
@@ -46,12 +49,19 @@ func (c *Bulk) Delete(id string) *Bulk {
 }
 
 func (c *Bulk) Exec() (ids []string, err error) {
+	return c.exec(context.Background())
+}
+
+func (c *Bulk) exec(ctx context.Context) (ids []string, err error) {
 
 	c.db.mutex.Lock()
 	defer c.db.mutex.Unlock()
 
 	var allKvs []store.KV
 	for _, v := range c.actions {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
 		if v.Type == add {
 			kvs, id, err := c.db.add(c.table, v.Document)
 			if err != nil {
@@ -77,6 +87,9 @@ func (c *Bulk) Exec() (ids []string, err error) {
 			ids = append(ids, v.Id)
 		}
 	}
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
 	err = c.db.store.SetKV(c.table, allKvs)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,230 @@
+package kv2doc
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/dpwgc/kv2doc/store"
+	"sort"
+	"strings"
+)
+
+// 重建索引时每批处理的文档数量
+const reindexBatch = 1000
+
+// Report 数据一致性检查报告
+type Report struct {
+	Documents int      // 扫描的文档数量
+	Indexes   int      // 扫描的索引数量
+	Orphans   []string // 孤立索引：对应的文档不存在，或者文档字段值与索引不一致
+	Missing   []string // 缺失索引：文档中存在该字段，但没有对应的索引（或者覆盖索引保存的字段值已过期）
+	Corrupt   []string // 损坏文档：文档内容无法解析为 Json
+}
+
+// IsHealthy 是否没有发现任何问题
+func (c Report) IsHealthy() bool {
+	return len(c.Orphans) <= 0 && len(c.Missing) <= 0 && len(c.Corrupt) <= 0
+}
+
+// Check 检查指定表的文档与字段索引是否一致
+// 检查期间会阻塞写操作，不影响读操作
+func (c *DB) Check(table string) (report Report, err error) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.check(table)
+}
+
+func (c *DB) check(table string) (report Report, err error) {
+	if len(table) <= 0 {
+		return Report{}, errors.New("parameter error")
+	}
+	// 提前加载字段定义，扫描过程中生成索引时不会再出错
+	_, err = c.schema(table)
+	if err != nil {
+		return Report{}, err
+	}
+	// 根据文档内容推算出应当存在的索引
+	expected := make(map[string][]byte)
+	corrupt := make(map[string]bool)
+	prefix := toPath(primaryPrefix, primaryKey, "")
+	err = c.store.ScanKV(table, prefix, func(key string, value []byte) bool {
+		report.Documents++
+		doc := Doc{}
+		if json.Unmarshal(value, &doc) != nil || !doc.IsValid() {
+			report.Corrupt = append(report.Corrupt, key)
+			corrupt[strings.TrimPrefix(key, prefix)] = true
+			return true
+		}
+		indexes, _ := c.indexKVs(table, doc)
+		for _, v := range indexes {
+			expected[v.Key] = v.Value
+		}
+		return true
+	})
+	if err != nil {
+		return Report{}, err
+	}
+	// 对比实际存在的索引
+	for _, prefix := range indexPrefixes {
+		err = c.store.ScanKV(table, toPath(prefix, ""), func(key string, value []byte) bool {
+			report.Indexes++
+			if v, ok := expected[key]; ok {
+				// 覆盖索引中保存的字段值过期时，当作缺失索引处理，重建索引时会覆盖
+				if string(v) == string(value) {
+					delete(expected, key)
+				}
+			} else if !corrupt[toID(value)] {
+				// 损坏文档的索引无法判断，不算作孤立索引
+				report.Orphans = append(report.Orphans, key)
+			}
+			return true
+		})
+		if err != nil {
+			return Report{}, err
+		}
+	}
+	for k := range expected {
+		report.Missing = append(report.Missing, k)
+	}
+	sort.Strings(report.Missing)
+	return report, nil
+}
+
+// Reindex 根据文档内容重建指定表的全部字段索引，并清理孤立索引
+// 按批次执行，每批只短暂持有写锁，不会在整个重建期间阻塞其他操作
+// 向量字段的近似索引会在重建前根据当前数据重新训练聚类中心
+func (c *DB) Reindex(table string) error {
+	if len(table) <= 0 {
+		return errors.New("parameter error")
+	}
+
+	// 重新训练向量字段的聚类中心，重建期间暂存，查询仍然使用旧的聚类中心及倒排列表
+	staged, err := c.train(table)
+	if err != nil {
+		return err
+	}
+	defer c.stage(table, nil)
+
+	// 收集所有文档 id
+	var ids []string
+	prefix := toPath(primaryPrefix, primaryKey, "")
+	err = c.store.ScanKV(table, prefix, func(key string, value []byte) bool {
+		ids = append(ids, strings.TrimPrefix(key, prefix))
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	// 分批重写索引
+	for i := 0; i < len(ids); i += reindexBatch {
+		end := i + reindexBatch
+		if end > len(ids) {
+			end = len(ids)
+		}
+		err = c.reindex(table, ids[i:end])
+		if err != nil {
+			return err
+		}
+	}
+
+	// 所有文档都已建立新的倒排列表，替换聚类中心
+	err = c.publish(table, staged)
+	if err != nil {
+		return err
+	}
+
+	// 分批清理孤立索引（包括旧的倒排列表）
+	report, err := c.check(table)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(report.Orphans); i += reindexBatch {
+		end := i + reindexBatch
+		if end > len(report.Orphans) {
+			end = len(report.Orphans)
+		}
+		err = c.clean(table, report.Orphans[i:end])
+		if err != nil {
+			return err
+		}
+	}
+
+	// 所有文档都已建立时间索引
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.store.SetKV(table, []store.KV{timeBuilt()})
+}
+
+func (c *DB) reindex(table string, ids []string) error {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var kvs []store.KV
+	for _, id := range ids {
+		doc, err := c.get(table, id)
+		if err != nil {
+			return err
+		}
+		if doc == nil {
+			continue
+		}
+		indexes, err := c.indexKVs(table, doc)
+		if err != nil {
+			return err
+		}
+		kvs = append(kvs, indexes...)
+	}
+	return c.store.SetKV(table, kvs)
+}
+
+func (c *DB) clean(table string, keys []string) error {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var kvs []store.KV
+	for _, key := range keys {
+		// 加锁后重新确认该索引仍然是孤立的
+		id := key[strings.LastIndex(key, "/")+1:]
+		doc, err := c.get(table, id)
+		if err != nil {
+			return err
+		}
+		indexes, err := c.indexKVs(table, doc)
+		if err != nil {
+			return err
+		}
+		orphan := true
+		for _, v := range indexes {
+			if v.Key == key {
+				orphan = false
+				break
+			}
+		}
+		if orphan {
+			kvs = append(kvs, store.KV{
+				Key: key,
+			})
+		}
+	}
+	return c.store.SetKV(table, kvs)
+}
+
+// 获取指定文档，文档不存在或者无法解析时返回 nil
+func (c *DB) get(table string, id string) (Doc, error) {
+	kv, err := c.store.GetKV(table, toPath(primaryPrefix, primaryKey, id))
+	if err != nil {
+		return nil, err
+	}
+	if !kv.HasValue() {
+		return nil, nil
+	}
+	doc := Doc{}
+	if json.Unmarshal(kv.Value, &doc) != nil || !doc.IsValid() {
+		return nil, nil
+	}
+	return doc, nil
+}
@@ -0,0 +1,170 @@
+package kv2doc_test
+
+import (
+	"github.com/dpwgc/kv2doc"
+	"github.com/dpwgc/kv2doc/store"
+	"strings"
+	"testing"
+)
+
+func TestCheckReindex(t *testing.T) {
+	tests := []struct {
+		name string
+		// 直接修改底层存储，制造不一致
+		damage      func(t *testing.T, s store.Store, ids []string)
+		wantOrphans int
+		wantMissing int
+	}{
+		{
+			name:   "healthy",
+			damage: func(t *testing.T, s store.Store, ids []string) {},
+		},
+		{
+			name: "missing field index",
+			damage: func(t *testing.T, s store.Store, ids []string) {
+				deleteKeys(t, s, "f/role/admin/"+ids[1])
+			},
+			wantMissing: 1,
+		},
+		{
+			name: "orphan field index",
+			damage: func(t *testing.T, s store.Store, ids []string) {
+				setKV(t, s, store.KV{Key: "f/role/root/999", Value: []byte("999")})
+			},
+			wantOrphans: 1,
+		},
+		{
+			name: "stale document",
+			damage: func(t *testing.T, s store.Store, ids []string) {
+				// 文档字段值变化，但索引没有更新
+				kv, err := s.GetKV("users", "p/_id/"+ids[0])
+				if err != nil {
+					t.Fatal(err)
+				}
+				doc := kv2doc.Doc{}.FromBytes(kv.Value)
+				doc["role"] = "root"
+				setKV(t, s, store.KV{Key: kv.Key, Value: doc.ToBytes()})
+			},
+			wantOrphans: 1,
+			wantMissing: 1,
+		},
+		{
+			name: "missing time index",
+			damage: func(t *testing.T, s store.Store, ids []string) {
+				deleteKeys(t, s, scanKeys(t, s, "t/")...)
+			},
+			// 每个文档的创建时间与更新时间
+			wantMissing: 2 * 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, s := newTestDB(t)
+			ids := addDocs(t, db, "users",
+				kv2doc.Doc{"name": "alice", "role": "admin"},
+				kv2doc.Doc{"name": "bob", "role": "admin"},
+				kv2doc.Doc{"name": "carol", "role": "guest"},
+			)
+			tt.damage(t, s, ids)
+
+			report, err := db.Check("users")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Documents != 3 {
+				t.Errorf("Documents = %d, want 3", report.Documents)
+			}
+			if len(report.Orphans) != tt.wantOrphans || len(report.Missing) != tt.wantMissing {
+				t.Errorf("Orphans = %v, Missing = %v, want %d orphans and %d missing", report.Orphans, report.Missing, tt.wantOrphans, tt.wantMissing)
+			}
+			if report.IsHealthy() != (tt.wantOrphans == 0 && tt.wantMissing == 0) {
+				t.Errorf("IsHealthy = %v", report.IsHealthy())
+			}
+
+			if err = db.Reindex("users"); err != nil {
+				t.Fatal(err)
+			}
+			report, err = db.Check("users")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !report.IsHealthy() {
+				t.Errorf("after Reindex: %+v", report)
+			}
+			// 修复后索引查询与全表扫描的结果一致
+			for _, v := range []string{"admin", "guest", "root"} {
+				indexed, err := db.Query("users").Eq("role", v).Count()
+				if err != nil {
+					t.Fatal(err)
+				}
+				scanned, err := db.Query("users").Like("role", v).Count()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if indexed != scanned {
+					t.Errorf("role %s: index count %d, scan count %d", v, indexed, scanned)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckCorruptDocument(t *testing.T) {
+	db, s := newTestDB(t)
+	ids := addDocs(t, db, "users", kv2doc.Doc{"name": "alice"}, kv2doc.Doc{"name": "bob"})
+	setKV(t, s, store.KV{Key: "p/_id/" + ids[1], Value: []byte("not json")})
+
+	report, err := db.Check("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Corrupt) != 1 || report.IsHealthy() {
+		t.Fatalf("Corrupt = %v, want 1 corrupt document", report.Corrupt)
+	}
+	if !strings.HasSuffix(report.Corrupt[0], ids[1]) {
+		t.Errorf("Corrupt = %v, want document %s", report.Corrupt, ids[1])
+	}
+}
+
+// 删除文档时一并删除它的索引
+func TestDeleteRemovesIndexes(t *testing.T) {
+	db, s := newTestDB(t)
+	ids := addDocs(t, db, "users", kv2doc.Doc{"name": "alice", "role": "admin"})
+	if err := db.Delete("users", ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	for _, prefix := range []string{"p/", "f/"} {
+		if keys := scanKeys(t, s, prefix); len(keys) > 0 {
+			t.Errorf("keys left after Delete: %v", keys)
+		}
+	}
+}
+
+func setKV(t *testing.T, s store.Store, kvs ...store.KV) {
+	t.Helper()
+	if err := s.SetKV("users", kvs); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func deleteKeys(t *testing.T, s store.Store, keys ...string) {
+	t.Helper()
+	var kvs []store.KV
+	for _, v := range keys {
+		kvs = append(kvs, store.KV{Key: v})
+	}
+	setKV(t, s, kvs...)
+}
+
+func scanKeys(t *testing.T, s store.Store, prefix string) []string {
+	t.Helper()
+	var keys []string
+	err := s.ScanKV("users", prefix, func(key string, value []byte) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
@@ -0,0 +1,197 @@
+package kv2doc
+
+// 查询条件树的节点类型
+const (
+	nodeLeaf = iota
+	nodeAnd
+	nodeOr
+	nodeNot
+)
+
+// 查询条件树，叶子节点是单个表达式，其他节点按交集、并集、取反组合子节点
+type node struct {
+	operator uint8
+	children []*node
+	// 叶子节点的表达式
+	expr string
+	// 叶子节点可以走的索引条件
+	indexes []Index
+	// 叶子节点对应的 Json 过滤条件，为 nil 时无法序列化
+	filter map[string]any
+}
+
+// Not 取反拼接，子查询中的条件之间为交集，即 !(a && b && ...)
+// 取反的条件不会走索引
+func (c *Query) Not(sc *Query) *Query {
+	c.clauses = append(c.clauses, &node{
+		operator: nodeNot,
+		children: []*node{{
+			operator: nodeAnd,
+			children: c.merge(sc),
+		}},
+	})
+	return c
+}
+
+// 添加一个表达式条件，与其他条件之间为交集
+func (c *Query) add(expr string) {
+	c.clauses = append(c.clauses, &node{
+		expr: expr,
+	})
+}
+
+// 最后添加的条件，构建查询时用于记录该条件的索引条件及 Json 过滤条件
+func (c *Query) last() *node {
+	return c.clauses[len(c.clauses)-1]
+}
+
+// 条件树的根节点，各个条件之间为交集
+func (c *Query) root() *node {
+	return &node{
+		operator: nodeAnd,
+		children: c.clauses,
+	}
+}
+
+// 各个条件的表达式
+func (c *Query) conditions() []string {
+	var ss []string
+	for _, v := range c.clauses {
+		ss = append(ss, v.String())
+	}
+	return ss
+}
+
+// 可以走索引的查询条件，具体走哪个索引由执行时的代价估算决定
+func (c *Query) candidates() []Index {
+	indexes := c.root().candidates()
+	if c.nearest != nil && c.nearest.index != nil {
+		indexes = append(indexes, *c.nearest.index)
+	}
+	return indexes
+}
+
+// 复制条件树，并替换叶子节点表达式中的参数名
+func (c *node) rename(names map[string]string) *node {
+	n := *c
+	if c.operator == nodeLeaf {
+		expr, err := rename(c.expr, func(name string) (string, bool) {
+			v, ok := names[name]
+			return v, ok
+		})
+		// 无法解析的表达式在构建查询时已经记录了错误，保持原样
+		if err == nil {
+			n.expr = expr
+		}
+		return &n
+	}
+	n.children = make([]*node, len(c.children))
+	for i, v := range c.children {
+		n.children[i] = v.rename(names)
+	}
+	return &n
+}
+
+func (c *node) String() string {
+	switch c.operator {
+	case nodeAnd:
+		return c.join(" && ", "(true)")
+	case nodeOr:
+		return c.join(" || ", "(false)")
+	case nodeNot:
+		return `(!` + c.children[0].String() + `)`
+	}
+	return c.expr
+}
+
+func (c *node) join(operator, empty string) string {
+	if len(c.children) <= 0 {
+		return empty
+	}
+	if len(c.children) == 1 {
+		return c.children[0].String()
+	}
+	s := `(`
+	for i, v := range c.children {
+		if i > 0 {
+			s += operator
+		}
+		s += v.String()
+	}
+	return s + `)`
+}
+
+// 提取可以走索引的条件
+// 交集节点任意一个子节点的索引条件都可以使用；并集节点的每个分支都有索引条件时，逐个分支扫描索引后合并结果；取反节点不能走索引
+func (c *node) candidates() []Index {
+	switch c.operator {
+	case nodeLeaf:
+		return c.indexes
+	case nodeAnd:
+		var indexes []Index
+		for _, v := range c.children {
+			indexes = append(indexes, v.candidates()...)
+		}
+		return indexes
+	case nodeOr:
+		if len(c.children) <= 0 {
+			return nil
+		}
+		union := Index{
+			operator: should,
+		}
+		for _, v := range c.children {
+			// 每个分支选一个索引条件，优先选择等值条件
+			var branch *Index
+			indexes := v.candidates()
+			for i := range indexes {
+				if branch == nil || (branch.operator != eq && indexes[i].operator == eq) {
+					branch = &indexes[i]
+				}
+			}
+			if branch == nil {
+				return nil
+			}
+			union.union = append(union.union, *branch)
+		}
+		return []Index{union}
+	}
+	return nil
+}
+
+// 展开嵌套的交集节点，返回各个交集条件
+func (c *node) conjuncts() []*node {
+	if c.operator != nodeAnd {
+		return []*node{c}
+	}
+	var ns []*node
+	for _, v := range c.children {
+		ns = append(ns, v.conjuncts()...)
+	}
+	return ns
+}
+
+// 转换为 Json 过滤条件，存在无法序列化的条件时返回 false
+func (c *node) toFilter() (map[string]any, bool) {
+	if c.operator == nodeLeaf {
+		return c.filter, c.filter != nil
+	}
+	var filters []map[string]any
+	for _, v := range c.children {
+		filter, ok := v.toFilter()
+		if !ok {
+			return nil, false
+		}
+		filters = append(filters, filter)
+	}
+	switch c.operator {
+	case nodeOr:
+		if filters == nil {
+			filters = []map[string]any{}
+		}
+		return map[string]any{opOr: filters}, true
+	case nodeNot:
+		return map[string]any{opNot: filters[0]}, true
+	}
+	return mergeFilters(filters), true
+}
@@ -0,0 +1,128 @@
+package kv2doc_test
+
+import (
+	"fmt"
+	"github.com/dpwgc/kv2doc"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestConditionTree(t *testing.T) {
+	db, _ := newTestDB(t)
+	colors := []string{"red", "blue", "green"}
+	var docs []kv2doc.Doc
+	for i := 0; i < 36; i++ {
+		typ := "1"
+		if i%6 == 0 {
+			typ = "0"
+		}
+		docs = append(docs, kv2doc.Doc{
+			"type":  typ,
+			"title": []string{"hello", "world", "hi"}[i%3],
+			"color": colors[i/3%3],
+			"price": fmt.Sprint(i),
+		})
+	}
+	addDocs(t, db, "items", docs...)
+	price := func(doc kv2doc.Doc) int {
+		n, _ := strconv.Atoi(doc["price"])
+		return n
+	}
+
+	tests := []struct {
+		name  string
+		query func() *kv2doc.Query
+		match func(doc kv2doc.Doc) bool
+		// 从条件树中提取出的候选索引
+		wantIndexes []string
+	}{
+		{
+			name: "nested",
+			// type == 1 && (title == "hello" || (color == "red" && !(price < 10)))
+			query: func() *kv2doc.Query {
+				return db.Query("items").Eq("type", "1").Should(kv2doc.Expr().
+					Eq("title", "hello").
+					Must(kv2doc.Expr().Eq("color", "red").Not(kv2doc.Expr().Lt("price", "10"))))
+			},
+			match: func(doc kv2doc.Doc) bool {
+				return doc["type"] == "1" && (doc["title"] == "hello" || (doc["color"] == "red" && !(price(doc) < 10)))
+			},
+			wantIndexes: []string{"f/type/1/", "f/title/hello/ | f/color/red/"},
+		},
+		{
+			name: "not",
+			query: func() *kv2doc.Query {
+				return db.Query("items").Not(kv2doc.Expr().Eq("color", "red").Gt("price", "20"))
+			},
+			match: func(doc kv2doc.Doc) bool {
+				return !(doc["color"] == "red" && price(doc) > 20)
+			},
+		},
+		{
+			// 取反节点中的索引条件不能使用，交集节点中其他条件的索引仍然可以使用
+			name: "not with indexed sibling",
+			query: func() *kv2doc.Query {
+				return db.Query("items").Eq("title", "hi").Not(kv2doc.Expr().Eq("color", "blue"))
+			},
+			match: func(doc kv2doc.Doc) bool {
+				return doc["title"] == "hi" && doc["color"] != "blue"
+			},
+			wantIndexes: []string{"f/title/hi/"},
+		},
+		{
+			name: "double not",
+			query: func() *kv2doc.Query {
+				return db.Query("items").Not(kv2doc.Expr().Not(kv2doc.Expr().Eq("color", "green")))
+			},
+			match: func(doc kv2doc.Doc) bool {
+				return doc["color"] == "green"
+			},
+		},
+		{
+			name: "should of musts",
+			query: func() *kv2doc.Query {
+				return db.Query("items").Should(kv2doc.Expr().
+					Must(kv2doc.Expr().Eq("type", "0").Eq("color", "blue")).
+					Must(kv2doc.Expr().Eq("title", "world").Lt("price", "5")))
+			},
+			match: func(doc kv2doc.Doc) bool {
+				return (doc["type"] == "0" && doc["color"] == "blue") || (doc["title"] == "world" && price(doc) < 5)
+			},
+			// 每个分支选一个索引条件，优先选择等值条件
+			wantIndexes: []string{"f/type/0/ | f/title/world/"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var want []string
+			for _, v := range docs {
+				if tt.match(v) {
+					want = append(want, v["price"])
+				}
+			}
+			list, err := tt.query().List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, v := range list {
+				got = append(got, v["price"])
+			}
+			sort.Strings(got)
+			sort.Strings(want)
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			var indexes []string
+			for _, v := range tt.query().Explain().Plans {
+				if v.Access == "index" {
+					indexes = append(indexes, v.Indexes[0].String())
+				}
+			}
+			if fmt.Sprint(indexes) != fmt.Sprint(tt.wantIndexes) {
+				t.Errorf("candidate indexes = %v, want %v", indexes, tt.wantIndexes)
+			}
+		})
+	}
+}
@@ -0,0 +1,242 @@
+package kv2doc
+
+import (
+	"github.com/expr-lang/expr/ast"
+	"github.com/expr-lang/expr/parser"
+)
+
+// Select 只返回指定的字段（主键 _id 总会返回）
+// 如果查询用到的字段都保存在所选索引中（覆盖索引），会直接从索引中读取，不再读取文档内容
+func (c *Query) Select(fields ...string) *Query {
+	if c.isChild {
+		return c
+	}
+	c.selects = append([]string{}, fields...)
+	return c
+}
+
+// Exclude 不返回指定的字段
+func (c *Query) Exclude(fields ...string) *Query {
+	if c.isChild {
+		return c
+	}
+	c.excludes = append(c.excludes, fields...)
+	return c
+}
+
+// HideInternal 不返回内部系统字段 _fields（_id、_created、_updated 仍会返回）
+func (c *Query) HideInternal() *Query {
+	if c.isChild {
+		return c
+	}
+	c.hideInternal = true
+	return c
+}
+
+// 按 Select、Exclude、HideInternal 裁剪文档
+func (c *Query) project(doc Doc) Doc {
+	if doc == nil || (c.selects == nil && len(c.excludes) <= 0 && !c.hideInternal) {
+		return doc
+	}
+	out := Doc{}
+	if c.selects == nil {
+		for k, v := range doc {
+			out[k] = v
+		}
+	} else {
+		out[primaryKey] = doc[primaryKey]
+		for _, v := range c.selects {
+			if doc.HasField(v) {
+				out[v] = doc[v]
+			}
+		}
+		// 关联查询附加的字段总会返回
+		for _, v := range c.lookups {
+			if doc.HasField(v.as) {
+				out[v.as] = doc[v.as]
+			}
+		}
+	}
+	for _, v := range c.excludes {
+		delete(out, v)
+	}
+	if c.hideInternal {
+		delete(out, fields)
+	}
+	return out
+}
+
+// 执行查询需要读取的全部字段，返回 false 表示需要读取完整的文档
+func (c *Query) needs() ([]string, bool) {
+	if c.selects == nil {
+		return nil, false
+	}
+	needs := append([]string{primaryKey}, c.selects...)
+	needs = append(needs, c.orders...)
+	for _, v := range c.lookups {
+		needs = append(needs, v.local)
+	}
+	if c.nearest != nil {
+		needs = append(needs, c.nearest.field)
+	}
+	if len(c.clauses) > 0 {
+		refs, ok := references(c.root().String(), c.params)
+		if !ok {
+			return nil, false
+		}
+		needs = append(needs, refs...)
+	}
+	return needs, true
+}
+
+// 表达式中引用的字段（不包括绑定参数），无法确定时返回 false
+func references(code string, params map[string]any) ([]string, bool) {
+	tree, err := parser.Parse(code)
+	if err != nil {
+		return nil, false
+	}
+	v := newReferenceVisitor()
+	ast.Walk(&tree.Node, v)
+	var refs []string
+	envs := 0
+	for _, id := range v.identifiers {
+		if id == "$env" {
+			envs++
+			continue
+		}
+		if _, ok := params[id]; !ok && !v.callees[id] {
+			refs = append(refs, id)
+		}
+	}
+	// 除了 $env["字段名"] 以外的方式使用 $env 时，可能会用到任意字段
+	if envs != len(v.members) {
+		return nil, false
+	}
+	return append(refs, v.members...), true
+}
+
+type referenceVisitor struct {
+	identifiers []string
+	// 通过 $env["字段名"] 引用的字段
+	members  []string
+	callees  map[string]bool
+	declared map[string]bool
+}
+
+func newReferenceVisitor() *referenceVisitor {
+	return &referenceVisitor{
+		callees:  make(map[string]bool),
+		declared: make(map[string]bool),
+	}
+}
+
+func (c *referenceVisitor) Visit(node *ast.Node) {
+	switch n := (*node).(type) {
+	case *ast.IdentifierNode:
+		c.identifiers = append(c.identifiers, n.Value)
+	case *ast.MemberNode:
+		id, isID := n.Node.(*ast.IdentifierNode)
+		s, isString := n.Property.(*ast.StringNode)
+		if isID && isString && id.Value == "$env" {
+			c.members = append(c.members, s.Value)
+		}
+	case *ast.CallNode:
+		if id, ok := n.Callee.(*ast.IdentifierNode); ok {
+			c.callees[id.Value] = true
+		}
+	case *ast.VariableDeclaratorNode:
+		// let 声明的变量与函数名一样，不是文档字段
+		c.callees[n.Name] = true
+		c.declared[n.Name] = true
+	}
+}
+
+// 判断索引是否覆盖了查询需要的全部字段
+func (c *DB) covering(query Query, index Index) bool {
+	needs, ok := query.needs()
+	if !ok {
+		return false
+	}
+	schema, err := c.schema(query.table)
+	if err != nil {
+		return false
+	}
+	for _, leaf := range index.leaves() {
+		if leaf.operator != eq && leaf.operator != leftLike {
+			return false
+		}
+		covered := map[string]bool{
+			primaryKey: true,
+			leaf.field: true,
+		}
+		for _, v := range schema[leaf.field].Include {
+			covered[v] = true
+		}
+		for _, v := range needs {
+			if !covered[v] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// 扫描覆盖索引，直接用索引中的字段组成文档
+func (c *DB) scanCovering(table string, index Index, fn func(doc Doc) bool) error {
+	seen := make(map[string]bool)
+	stop := false
+	for _, leaf := range index.leaves() {
+		prefix := toPath(fieldPrefix, leaf.field, "")
+		err := c.scanLeaf(table, leaf, func(key string, value []byte) bool {
+			doc := toCover(value)
+			id := doc[primaryKey]
+			if seen[id] || len(key) < len(prefix)+len(id)+1 {
+				return true
+			}
+			seen[id] = true
+			// 索引 key 格式：f/字段名/字段值/主键
+			doc[leaf.field] = key[len(prefix) : len(key)-len(id)-1]
+			stop = !fn(doc)
+			return !stop
+		})
+		if err != nil || stop {
+			return err
+		}
+	}
+	return nil
+}
+
+// 解析索引 value，覆盖索引保存的是包含主键及额外字段的 Json，普通索引保存的是主键
+func toCover(value []byte) Doc {
+	if len(value) > 0 && value[0] == '{' {
+		return Doc{}.FromBytes(value)
+	}
+	return Doc{
+		primaryKey: string(value),
+	}
+}
+
+// 从索引 value 中取出主键
+func toID(value []byte) string {
+	if len(value) > 0 && value[0] == '{' {
+		return toCover(value)[primaryKey]
+	}
+	return string(value)
+}
+
+// 生成字段索引的 value，设置了覆盖字段时保存主键及覆盖字段的 Json，否则只保存主键
+func toCoverValue(doc Doc, field Field) []byte {
+	id := doc[primaryKey]
+	if len(field.Include) <= 0 {
+		return []byte(id)
+	}
+	cover := Doc{
+		primaryKey: id,
+	}
+	for _, v := range field.Include {
+		if doc.HasField(v) {
+			cover[v] = doc[v]
+		}
+	}
+	return cover.ToBytes()
+}
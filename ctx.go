@@ -0,0 +1,160 @@
+package kv2doc
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// 排序时每比较多少次检查一次 context 是否已取消
+const sortCheckInterval = 1024
+
+// Timeout 查询超时时间，从开始执行查询时计时，超时后中断扫描及排序并返回 context.DeadlineExceeded
+func (c *Query) Timeout(timeout time.Duration) *Query {
+	if c.isChild {
+		return c
+	}
+	c.timeout = timeout
+	return c
+}
+
+// MaxScanned 最多扫描的 key 数量（索引 key 或文档），超出后中断查询并返回错误，小于等于 0 时不限制
+func (c *Query) MaxScanned(n int) *Query {
+	if c.isChild {
+		return c
+	}
+	c.maxScanned = n
+	return c
+}
+
+// ListCtx 返回多个文档，ctx 取消或超时后中断查询并返回 ctx.Err()
+func (c *Query) ListCtx(ctx context.Context) (docs []Doc, err error) {
+	cc := *c
+	cc.ctx = ctx
+	return cc.List()
+}
+
+// CountCtx 返回文档数量，ctx 取消或超时后中断查询并返回 ctx.Err()
+func (c *Query) CountCtx(ctx context.Context) (count int64, err error) {
+	cc := *c
+	cc.ctx = ctx
+	return cc.Count()
+}
+
+// ScrollCtx 滚动查询，ctx 取消或超时后中断查询并返回 ctx.Err()
+func (c *Query) ScrollCtx(ctx context.Context, fn func(doc Doc) bool) error {
+	cc := *c
+	cc.ctx = ctx
+	return cc.Scroll(fn)
+}
+
+// AddCtx 在指定表中插入文档记录，ctx 在写入前取消或超时时不写入并返回 ctx.Err()
+func (c *DB) AddCtx(ctx context.Context, table string, doc Doc) (id string, err error) {
+	if err = ctx.Err(); err != nil {
+		return "", err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	// 等待写锁期间可能已经取消
+	if err = ctx.Err(); err != nil {
+		return "", err
+	}
+	kvs, id, err := c.add(table, doc)
+	if err != nil {
+		return "", err
+	}
+	err = c.store.SetKV(table, kvs)
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// ExecCtx 执行批量操作，ctx 在写入前取消或超时时不写入任何文档并返回 ctx.Err()
+func (c *Bulk) ExecCtx(ctx context.Context) (ids []string, err error) {
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.exec(ctx)
+}
+
+// 执行查询时使用的 context，设置了超时时间时从此刻开始计时
+// 返回的查询已经设置好 context，不会重复计时
+func (c Query) withContext() (Query, context.CancelFunc) {
+	cancel := func() {}
+	if c.ctx == nil {
+		c.ctx = context.Background()
+	}
+	if c.timeout > 0 {
+		c.ctx, cancel = context.WithTimeout(c.ctx, c.timeout)
+		c.timeout = 0
+	}
+	return c, cancel
+}
+
+// 扫描计数，检查是否取消、超时或者超出扫描数量限制
+type scanGuard struct {
+	ctx     context.Context
+	max     int
+	scanned int
+	// 中断扫描的原因
+	stop string
+}
+
+func (c *scanGuard) check() error {
+	c.scanned++
+	return c.err()
+}
+
+// 只检查不计数
+func (c *scanGuard) err() error {
+	if c.max > 0 && c.scanned > c.max {
+		c.stop = stopMaxScanned
+		return errors.New("scanned more than " + strconv.Itoa(c.max) + " keys")
+	}
+	if c.ctx == nil {
+		return nil
+	}
+	err := c.ctx.Err()
+	if err != nil {
+		c.stop = ctxStop(err)
+	}
+	return err
+}
+
+// context 中断查询的原因
+func ctxStop(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return stopTimeout
+	}
+	return stopCanceled
+}
+
+// 估算代价时每次探测最多扫描的 key 数量，不超过查询的扫描数量限制
+func (c *scanGuard) probeLimit() int64 {
+	if c.max > 0 && c.max < probeLimit {
+		return int64(c.max)
+	}
+	return probeLimit
+}
+
+// 排序，ctx 取消或超时后不再比较，并返回 ctx.Err()
+func sortCtx(ctx context.Context, rows []Doc, compare func(l, r Doc) bool) error {
+	var err error
+	n := 0
+	Sort(rows, func(l, r Doc) bool {
+		if err != nil {
+			return false
+		}
+		n++
+		if n%sortCheckInterval == 0 {
+			err = ctx.Err()
+		}
+		return compare(l, r)
+	})
+	if err != nil {
+		return err
+	}
+	return ctx.Err()
+}
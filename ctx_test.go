@@ -0,0 +1,103 @@
+package kv2doc_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dpwgc/kv2doc"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryCtx(t *testing.T) {
+	db, _ := newTestDB(t)
+	bulk := db.Bulk("jobs")
+	for i := 0; i < 50; i++ {
+		bulk.Add(kv2doc.Doc{"queue": fmt.Sprint(i % 5), "worker": fmt.Sprint(i / 10), "n": fmt.Sprint(i)})
+	}
+	if _, err := bulk.Exec(); err != nil {
+		t.Fatal(err)
+	}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancelExpired := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancelExpired()
+
+	tests := []struct {
+		name string
+		run  func() error
+		// 期望的错误，为 nil 时期望错误信息中包含 wantText
+		want     error
+		wantText string
+	}{
+		{"list canceled", func() error { _, err := db.Query("jobs").ListCtx(canceled); return err }, context.Canceled, ""},
+		{"count canceled", func() error { _, err := db.Query("jobs").Eq("queue", "1").CountCtx(canceled); return err }, context.Canceled, ""},
+		{"scroll expired", func() error {
+			return db.Query("jobs").ScrollCtx(expired, func(doc kv2doc.Doc) bool { return true })
+		}, context.DeadlineExceeded, ""},
+		{"sorted canceled", func() error { _, err := db.Query("jobs").Desc("n").ListCtx(canceled); return err }, context.Canceled, ""},
+		{"timeout", func() error { _, err := db.Query("jobs").Timeout(time.Nanosecond).List(); return err }, context.DeadlineExceeded, ""},
+		{"max scanned", func() error { _, err := db.Query("jobs").Gt("n", "-1").MaxScanned(20).List(); return err }, nil, "scanned more than 20"},
+		{"max scanned index", func() error { _, err := db.Query("jobs").Eq("queue", "2").MaxScanned(5).Count(); return err }, nil, "scanned more than 5"},
+		// 取交集时扫描的索引 key 同样计入
+		{"max scanned intersect", func() error {
+			_, err := db.Query("jobs").Eq("queue", "2").Eq("worker", "1").MaxScanned(15).Count()
+			return err
+		}, nil, "scanned more than 15"},
+		{"intersect canceled", func() error {
+			_, err := db.Query("jobs").Eq("queue", "2").Eq("worker", "1").CountCtx(canceled)
+			return err
+		}, context.Canceled, ""},
+	}
+	if explain := db.Query("jobs").Eq("queue", "2").Eq("worker", "1").Explain(); explain.Plan.Access != "intersect" {
+		t.Fatalf("Plan = %+v, want an intersect", explain.Plan)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.run()
+			if err == nil {
+				t.Fatal("no error")
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("error = %v, want %v", err, tt.want)
+			}
+			if tt.want == nil && !strings.Contains(err.Error(), tt.wantText) {
+				t.Errorf("error = %v, want it to contain %q", err, tt.wantText)
+			}
+		})
+	}
+
+	// 扫描数量没有超出限制时正常返回
+	docs, err := db.Query("jobs").Eq("queue", "2").MaxScanned(10).Timeout(time.Minute).ListCtx(context.Background())
+	if err != nil || len(docs) != 10 {
+		t.Errorf("ListCtx() = %d documents, %v, want 10 documents", len(docs), err)
+	}
+}
+
+func TestWriteCtx(t *testing.T) {
+	db, _ := newTestDB(t)
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := db.AddCtx(canceled, "jobs", kv2doc.Doc{"n": "1"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("AddCtx() error = %v, want context.Canceled", err)
+	}
+	bulk := db.Bulk("jobs").Add(kv2doc.Doc{"n": "2"}).Add(kv2doc.Doc{"n": "3"})
+	if _, err := bulk.ExecCtx(canceled); !errors.Is(err, context.Canceled) {
+		t.Errorf("ExecCtx() error = %v, want context.Canceled", err)
+	}
+	// 取消后没有写入任何文档
+	if count, err := db.Query("jobs").Count(); err != nil || count != 0 {
+		t.Errorf("Count() = %d, %v, want 0", count, err)
+	}
+
+	ids, err := bulk.ExecCtx(context.Background())
+	if err != nil || len(ids) != 2 {
+		t.Fatalf("ExecCtx() = %v, %v", ids, err)
+	}
+	if count, err := db.Query("jobs").Count(); err != nil || count != 2 {
+		t.Errorf("Count() = %d, %v, want 2", count, err)
+	}
+}
@@ -1,9 +1,11 @@
 package kv2doc
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/dpwgc/kv2doc/store"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -18,9 +20,19 @@ const (
 	fieldPrefix   = "f"
 )
 
+// 所有索引的 key 前缀
+var indexPrefixes = []string{fieldPrefix, geoPrefix, vectorPrefix, normPrefix, timePrefix}
+
 type DB struct {
-	store store.Store
-	mutex *sync.Mutex
+	store   store.Store
+	mutex   *sync.Mutex
+	schemas *sync.Map
+	// 向量字段的聚类中心缓存
+	centroids *sync.Map
+	// 重建索引期间新训练的聚类中心
+	staged *sync.Map
+	// 每张表的表达式解析器，缓存已编译的表达式
+	parsers *sync.Map
 }
 
 // NewDB 开启一个数据库，不存在时自动建库，底层基于 BoltDB
@@ -35,8 +47,12 @@ func NewDB(path string) (*DB, error) {
 // ByStore 开启一个数据库（自定义底层存储引擎实现）
 func ByStore(store store.Store) *DB {
 	return &DB{
-		store: store,
-		mutex: &sync.Mutex{},
+		store:     store,
+		mutex:     &sync.Mutex{},
+		schemas:   &sync.Map{},
+		centroids: &sync.Map{},
+		staged:    &sync.Map{},
+		parsers:   &sync.Map{},
 	}
 }
 
@@ -50,6 +66,16 @@ func (c *DB) Drop(table string) error {
 		return errors.New("parameter error")
 	}
 
+	c.schemas.Delete(table)
+	c.parsers.Delete(table)
+	for _, m := range []*sync.Map{c.centroids, c.staged} {
+		m.Range(func(key, value any) bool {
+			if strings.HasPrefix(key.(string), table+"/") {
+				m.Delete(key)
+			}
+			return true
+		})
+	}
 	return c.store.DropTable(table)
 }
 
@@ -79,6 +105,10 @@ func (c *DB) add(table string, doc Doc) (kvs []store.KV, id string, err error) {
 	if err != nil {
 		return nil, "", err
 	}
+	kvs, err = c.timeMarker(table)
+	if err != nil {
+		return nil, "", err
+	}
 
 	id, err = c.store.NextID(table)
 	if err != nil {
@@ -93,12 +123,11 @@ func (c *DB) add(table string, doc Doc) (kvs []store.KV, id string, err error) {
 		Key:   toPath(primaryPrefix, primaryKey, id),
 		Value: doc.ToBytes(),
 	})
-	for k, v := range doc {
-		kvs = append(kvs, store.KV{
-			Key:   toPath(fieldPrefix, k, v, id),
-			Value: []byte(id),
-		})
+	indexes, err := c.indexKVs(table, doc)
+	if err != nil {
+		return nil, "", err
 	}
+	kvs = append(kvs, indexes...)
 	return kvs, id, nil
 }
 
@@ -140,22 +169,28 @@ func (c *DB) edit(table string, id string, doc Doc) (kvs []store.KV, err error)
 		Value: doc.ToBytes(),
 	})
 
-	for k := range old {
-		// 如果新保存的文档不包含这个老的字段
-		if old.HasField(k) && !doc.HasField(k) {
-			// 删除这个字段
+	indexes, err := c.indexKVs(table, doc)
+	if err != nil {
+		return nil, err
+	}
+	olds, err := c.indexKVs(table, old)
+	if err != nil {
+		return nil, err
+	}
+	keep := make(map[string]bool)
+	for _, v := range indexes {
+		keep[v.Key] = true
+	}
+	for _, v := range olds {
+		// 如果新保存的文档不包含这个老的字段，或者字段值发生了变化，删除老的索引
+		if !keep[v.Key] {
 			kvs = append(kvs, store.KV{
-				Key: toPath(fieldPrefix, k, old[k], id),
+				Key: v.Key,
 			})
 		}
 	}
 
-	for k, v := range doc {
-		kvs = append(kvs, store.KV{
-			Key:   toPath(fieldPrefix, k, v, id),
-			Value: []byte(id),
-		})
-	}
+	kvs = append(kvs, indexes...)
 
 	return kvs, nil
 }
@@ -190,17 +225,76 @@ func (c *DB) delete(table string, id string) (kvs []store.KV, err error) {
 	kvs = append(kvs, store.KV{
 		Key: toPath(primaryPrefix, primaryKey, id),
 	})
-	for k, v := range old {
+	olds, err := c.indexKVs(table, old)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range olds {
 		kvs = append(kvs, store.KV{
-			Key: toPath(fieldPrefix, k, v, old[primaryKey]),
+			Key: v.Key,
 		})
 	}
-	return nil, nil
+	return kvs, nil
+}
+
+// 生成文档的全部索引
+func (c *DB) indexKVs(table string, doc Doc) (kvs []store.KV, err error) {
+	schema, err := c.schema(table)
+	if err != nil {
+		return nil, err
+	}
+	id := doc[primaryKey]
+	for k, v := range doc {
+		// 不满足部分索引条件的文档，不建立该字段的索引
+		if !c.covers(table, schema[k], doc) {
+			continue
+		}
+		kvs = append(kvs, store.KV{
+			Key:   toPath(fieldPrefix, k, v, id),
+			Value: toCoverValue(doc, schema[k]),
+		})
+		// 创建时间和更新时间，额外建立按时间排序的索引
+		if k == createdAt || k == updatedAt {
+			if ms, err := strconv.ParseInt(v, 10, 64); err == nil && ms >= 0 {
+				kvs = append(kvs, store.KV{
+					Key:   toPath(timePrefix, k, toTime(ms), id),
+					Value: []byte(id),
+				})
+			}
+		}
+		// 设置了归一化方式的字段，额外建立归一化索引
+		if len(schema[k].Normalizers) > 0 {
+			kvs = append(kvs, store.KV{
+				Key:   toPath(normPrefix, k, normalize(v, schema[k].Normalizers), id),
+				Value: []byte(id),
+			})
+		}
+		// 地理位置字段，额外建立 geohash 索引
+		if schema[k].Type == Geo {
+			if p, ok := toPoint(v); ok {
+				kvs = append(kvs, store.KV{
+					Key:   toPath(geoPrefix, k, geohash(p, geoPrecision), id),
+					Value: []byte(id),
+				})
+			}
+		}
+		// 向量字段，训练过聚类中心后额外建立倒排索引
+		if schema[k].Type == Vector {
+			for _, list := range c.assign(table, schema[k], v) {
+				kvs = append(kvs, store.KV{
+					Key:   toPath(vectorPrefix, k, list, id),
+					Value: []byte(id),
+				})
+			}
+		}
+	}
+	return kvs, nil
 }
 
 // Bulk 批量操作
 func (c *DB) Bulk(table string) *Bulk {
 	return &Bulk{
+		db:    c,
 		table: table,
 	}
 }
@@ -210,19 +304,43 @@ func (c *DB) Query(table string) *Query {
 	return &Query{
 		db:      c,
 		table:   table,
-		parser:  NewParser(),
+		parser:  c.parserOf(table),
 		isChild: false,
 	}
 }
 
+// 获取表的表达式解析器
+func (c *DB) parserOf(table string) *Parser {
+	if v, ok := c.parsers.Load(table); ok {
+		return v.(*Parser)
+	}
+	v, _ := c.parsers.LoadOrStore(table, NewParser().function("normalize", c.normalizeFunc(table)))
+	return v.(*Parser)
+}
+
 // 查询
 func query(query Query, justCount bool) (count int64, docs []Doc, err error) {
+	query, cancel := query.withContext()
+	defer cancel()
 	count = 0
 	cursor := 0
+	// 相似度查询，需要扫描全部候选文档后取最相似的前 k 个
+	var rank *ranker
+	if query.nearest != nil {
+		rank = newRanker(*query.nearest)
+	}
 	// 扫描
 	err = scan(query, func(doc Doc) bool {
+		if rank != nil {
+			rank.push(doc)
+			return true
+		}
 		// 到达页数限制，且没有排序规则，结束检索
 		if query.sort == nil && query.limit.enable && len(docs) >= query.limit.size {
+			if query.stats != nil {
+				query.stats.EarlyStop = true
+				query.stats.StopReason = stopLimit
+			}
 			return false
 		}
 		// 如果还未到达指定游标（有排序规则时就不走这个了）
@@ -240,9 +358,55 @@ func query(query Query, justCount bool) (count int64, docs []Doc, err error) {
 	if err != nil {
 		return 0, nil, err
 	}
+	defer func() {
+		if err != nil {
+			return
+		}
+		if err = query.attach(docs); err != nil {
+			count, docs = 0, nil
+			return
+		}
+		for i, v := range docs {
+			docs[i] = query.project(v)
+		}
+	}()
+	// 记录排序统计
+	if query.stats != nil && (query.sort != nil || rank != nil) {
+		query.stats.SortSize = len(docs)
+		query.stats.SortMethod = sortFull
+		if rank != nil {
+			query.stats.SortSize = rank.size()
+			query.stats.SortMethod = sortTopK
+		}
+	}
+	if rank != nil {
+		start := time.Now()
+		docs = rank.result()
+		if query.stats != nil {
+			query.stats.SortTime = time.Since(start)
+		}
+		if justCount {
+			return int64(len(docs)), nil, nil
+		}
+	}
 	// 最终排序
-	if query.sort != nil && len(docs) > 0 {
-		Sort(docs, query.sort)
+	if (query.sort != nil || rank != nil) && len(docs) > 0 {
+		if query.sort != nil {
+			start := time.Now()
+			err = sortCtx(query.ctx, docs, query.sort)
+			if query.stats != nil {
+				query.stats.SortTime += time.Since(start)
+				if err != nil {
+					query.stats.StopReason = ctxStop(err)
+				}
+			}
+			if err != nil {
+				return 0, nil, err
+			}
+		}
+		if !query.limit.enable {
+			return count, docs, nil
+		}
 		start := query.limit.cursor
 		end := start + query.limit.size
 		var sorted []Doc
@@ -264,52 +428,217 @@ func scan(query Query, fn func(doc Doc) bool) (err error) {
 	if len(query.table) <= 0 || query.db == nil || fn == nil {
 		return errors.New("parameter error")
 	}
-	filter := getFilter(query.expressions, query.parser)
-	if len(query.index.field) > 0 {
-		// 走索引
-		return query.db.store.ScanKV(query.table, toPath(fieldPrefix, query.index.field, query.index.value), func(key string, value []byte) bool {
-			doc := Doc{}
-			kv, _ := query.db.store.GetKV(query.table, toPath(primaryPrefix, primaryKey, string(value)))
-			if !kv.HasKey() {
-				return true
+	query, cancel := query.withContext()
+	defer cancel()
+	// 整个扫描在同一个只读快照中完成，逐个读取文档时不再嵌套开启读事务
+	db, snapshot, err := query.db.view()
+	if err != nil {
+		return err
+	}
+	if snapshot != nil {
+		defer func() {
+			if e := snapshot.Close(); err == nil {
+				err = e
 			}
-			doc = doc.FromBytes(kv.Value)
-			// 跳过异常文档
-			if !doc.IsValid() || len(doc[primaryKey]) <= 0 {
-				return true
+		}()
+	}
+	query.db = db
+	if query.stats == nil {
+		plan, _ := query.db.plan(query)
+		return scanWith(query, plan, fn)
+	}
+	start := time.Now()
+	plan, plans := query.db.plan(query)
+	query.stats.Plan, query.stats.Plans = plan, plans
+	query.stats.PlanTime = time.Since(start)
+	start = time.Now()
+	defer func() {
+		query.stats.ScanTime = time.Since(start)
+	}()
+	return scanWith(query, plan, fn)
+}
+
+// 按指定的访问路径扫描
+func scanWith(query Query, plan Plan, fn func(doc Doc) bool) (err error) {
+	if query.err != nil {
+		return query.err
+	}
+	match, err := query.matcher()
+	if err != nil {
+		return err
+	}
+	stats := query.stats
+	ctx := query.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	guard := &scanGuard{
+		ctx: ctx,
+		max: query.maxScanned,
+	}
+	if stats != nil {
+		defer func() {
+			if len(guard.stop) > 0 {
+				stats.StopReason = guard.stop
+			}
+		}()
+	}
+	// 估算代价时查询可能已经取消或超时
+	if err := guard.err(); err != nil {
+		return err
+	}
+	// 中断扫描的错误
+	var abort error
+	// 读取到一个 key，fetched 表示是否读取了文档，查询已取消、超时或者超出扫描数量限制时返回 false
+	read := func(fetched bool) bool {
+		if stats != nil {
+			stats.Keys++
+			if fetched {
+				stats.Fetched++
 			}
-			// 过滤逻辑
-			if filter != nil && !filter(doc) {
+		}
+		if err := guard.check(); err != nil {
+			abort = err
+			return false
+		}
+		return true
+	}
+	handle := func(doc Doc) bool {
+		ok, err := match(doc)
+		if err != nil {
+			abort = err
+			return false
+		}
+		if !ok {
+			return true
+		}
+		if stats != nil {
+			stats.Matched++
+		}
+		return fn(doc)
+	}
+	defer func() {
+		if err == nil {
+			err = abort
+		}
+	}()
+	switch plan.Access {
+	case accessCovering:
+		// 走覆盖索引，不读取文档内容
+		return query.db.scanCovering(query.table, plan.Indexes[0], func(doc Doc) bool {
+			if !read(false) {
+				return false
+			}
+			return handle(doc)
+		})
+	case accessIndex, accessRange:
+		// 走索引或时间索引区间
+		return query.db.scanIndex(query.table, plan.Indexes[0], func(id string) bool {
+			kv, err := query.db.store.GetKV(query.table, toPath(primaryPrefix, primaryKey, id))
+			if err != nil {
+				abort = err
+				return false
+			}
+			if !read(kv.HasKey()) {
+				return false
+			}
+			if !kv.HasKey() {
 				return true
 			}
-			return fn(doc)
+			return handle(Doc{}.FromBytes(kv.Value))
 		})
-	} else {
+	case accessIntersect:
+		// 多个索引取交集
+		ids, keys, err := query.db.intersect(query.table, plan.Indexes, guard)
+		if stats != nil {
+			stats.Keys += keys
+		}
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			// 索引 key 已经在取交集时计数
+			if err := guard.err(); err != nil {
+				return err
+			}
+			kv, err := query.db.store.GetKV(query.table, toPath(primaryPrefix, primaryKey, id))
+			if err != nil {
+				return err
+			}
+			if !kv.HasKey() {
+				continue
+			}
+			if stats != nil {
+				stats.Fetched++
+			}
+			if !handle(Doc{}.FromBytes(kv.Value)) {
+				break
+			}
+		}
+		return nil
+	default:
 		// 全表扫描
+		if len(query.start) > 0 {
+			// 从指定主键之后开始扫描
+			return query.db.rangeKV(query.table, toPath(primaryPrefix, primaryKey, query.start)+"\x00", toPath(primaryPrefix, primaryKey)+"0", func(key string, value []byte) bool {
+				if !read(true) {
+					return false
+				}
+				return handle(Doc{}.FromBytes(value))
+			})
+		}
 		return query.db.store.ScanKV(query.table, primaryPrefix, func(key string, value []byte) bool {
-			doc := Doc{}
-			doc = doc.FromBytes(value)
-			// 跳过异常文档
-			if !doc.IsValid() || len(doc[primaryKey]) <= 0 {
-				return true
-			}
-			// 过滤逻辑
-			if filter != nil && !filter(doc) {
-				return true
+			if !read(true) {
+				return false
 			}
-			return fn(doc)
+			return handle(Doc{}.FromBytes(value))
 		})
 	}
 }
 
-func getFilter(expressions []string, parser *Parser) func(doc Doc) bool {
-	if len(expressions) > 0 {
-		return func(doc Doc) bool {
-			match, _ := parser.Match(strings.Join(expressions, " && "), doc)
-			return match
+// 生成过滤函数，表达式在每次查询时只编译一次，无法编译时返回错误
+// 判断文档是否满足查询条件（跳过异常文档），有关联查询时同时完成关联
+func (c *Query) matcher() (func(doc Doc) (bool, error), error) {
+	filter, err := getFilter(c.conditions(), c.params, c.parser)
+	if err != nil {
+		return nil, err
+	}
+	cache := make(map[string]bool)
+	return func(doc Doc) (bool, error) {
+		// 跳过异常文档
+		if !doc.IsValid() || len(doc[primaryKey]) <= 0 {
+			return false, nil
 		}
+		// 过滤逻辑
+		if filter != nil {
+			match, err := filter(doc)
+			if err != nil && c.strict {
+				return false, errors.New("evaluate expression on document " + doc[primaryKey] + ": " + err.Error())
+			}
+			if !match {
+				return false, nil
+			}
+		}
+		// 内连接没有匹配的文档时不返回，左连接不影响返回哪些文档，等排序分页之后再关联
+		if len(c.lookups) > 0 {
+			return c.exists(doc, cache)
+		}
+		return true, nil
+	}, nil
+}
+
+func getFilter(expressions []string, params map[string]any, parser *Parser) (func(doc Doc) (bool, error), error) {
+	if len(expressions) <= 0 {
+		return nil, nil
+	}
+	code := strings.Join(expressions, " && ")
+	program := parser.compile(code)
+	if program.err != nil {
+		return nil, errors.New("compile expression " + code + ": " + program.err.Error())
 	}
-	return nil
+	return func(doc Doc) (bool, error) {
+		return program.match(toEnv(doc, params))
+	}, nil
 }
 
 func toPath(s ...string) string {
@@ -0,0 +1,95 @@
+package kv2doc_test
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dpwgc/kv2doc"
+	"github.com/dpwgc/kv2doc/store"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 在临时目录中创建数据库，返回数据库及底层存储（用于直接修改键值对）
+func newTestDB(t *testing.T) (*kv2doc.DB, store.Store) {
+	t.Helper()
+	s, err := store.NewBolt(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kv2doc.ByStore(s), s
+}
+
+// 依次写入文档，返回文档主键
+func addDocs(t *testing.T, db *kv2doc.DB, table string, docs ...kv2doc.Doc) []string {
+	t.Helper()
+	var ids []string
+	for _, v := range docs {
+		id, err := db.Add(table, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func toIDs(docs []kv2doc.Doc) []string {
+	var ids []string
+	for _, v := range docs {
+		ids = append(ids, v.ID())
+	}
+	return ids
+}
+
+// 删除表后重新写入，会重新建表
+func TestDropRecreate(t *testing.T) {
+	db, _ := newTestDB(t)
+	addDocs(t, db, "users", kv2doc.Doc{"name": "alice"})
+	if err := db.Drop("users"); err != nil {
+		t.Fatal(err)
+	}
+	addDocs(t, db, "users", kv2doc.Doc{"name": "bob"})
+	docs, err := db.Query("users").List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 1 || docs[0]["name"] != "bob" {
+		t.Errorf("List() after Drop = %v, want only bob", docs)
+	}
+}
+
+// 读取文档出错的存储
+type brokenStore struct {
+	store.Store
+}
+
+var errBroken = errors.New("broken store")
+
+func (c brokenStore) GetKV(table, key string) (store.KV, error) {
+	if strings.HasPrefix(key, "p/") {
+		return store.KV{}, errBroken
+	}
+	return c.Store.GetKV(table, key)
+}
+
+// 按主键读取文档出错时返回错误，而不是当作文档不存在
+func TestReadError(t *testing.T) {
+	db, s := newTestDB(t)
+	for i := 0; i < 20; i++ {
+		addDocs(t, db, "users", kv2doc.Doc{"role": fmt.Sprint("r", i%4), "team": fmt.Sprint("t", i/5)})
+	}
+	broken := kv2doc.ByStore(brokenStore{s})
+
+	for _, query := range []*kv2doc.Query{
+		broken.Query("users").Eq("role", "r1"),
+		broken.Query("users").Eq("role", "r1").Eq("team", "t2"),
+	} {
+		if access := query.Explain().Plan.Access; access == "scan" {
+			t.Fatalf("Plan.Access = %s, want an index access", access)
+		}
+		if docs, err := query.List(); !errors.Is(err, errBroken) {
+			t.Errorf("List() = %v, %v, want %v", docs, err, errBroken)
+		}
+	}
+}
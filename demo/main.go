@@ -53,6 +53,9 @@ func main() {
 	// 选择了哪个索引
 	fmt.Println("index:", explain.Index)
 
+	// 选中的访问路径及估算代价
+	fmt.Println("plan:", explain.Plan)
+
 	// 删除表
 	_ = db.Drop("test_table")
 }
@@ -0,0 +1,395 @@
+package kv2doc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Json 过滤条件的运算符
+const (
+	opEq         = "$eq"
+	opNe         = "$ne"
+	opGt         = "$gt"
+	opGte        = "$gte"
+	opLt         = "$lt"
+	opLte        = "$lte"
+	opIn         = "$in"
+	opNin        = "$nin"
+	opLike       = "$like"
+	opPrefix     = "$prefix"
+	opSuffix     = "$suffix"
+	opExists     = "$exists"
+	opEqFold     = "$eqFold"
+	opPrefixFold = "$prefixFold"
+	opRegex      = "$regex"
+	opBefore     = "$before"
+	opAfter      = "$after"
+	opEmpty      = "$empty"
+	opNumeric    = "$numeric"
+	opAnd        = "$and"
+	opOr         = "$or"
+	opNot        = "$not"
+	opWhere      = "$where"
+)
+
+// Find 使用 Json 过滤条件查询文档，语法见 Query.FromJSON
+func (c *DB) Find(table string, filter string) *Query {
+	return c.Query(table).FromJSON(filter)
+}
+
+// FromJSON 添加 Json 格式的过滤条件（与 MongoDB 的查询语法类似），同一个对象中的条件之间为交集
+// {"type": "1"} 等于，{"type": {"$ne": "1"}} 不等于，$gt、$gte、$lt、$lte 大于、大于等于、小于、小于等于
+// $in、$nin 包含、不包含，$like 含有，$prefix 相同前缀，$suffix 相同后缀，$exists 是否存在，$eqFold、$prefixFold 归一化后等于、相同前缀
+// $regex 正则匹配，$before、$after 时间早于、晚于，$empty 是否为空，$numeric 是否为数字
+// {"$and": [...]} 交集，{"$or": [...]} 并集，{"$not": {...}} 取反，{"$where": {"expr": "...", "params": {...}}} 原生表达式
+// 解析出错时，执行查询会返回错误
+func (c *Query) FromJSON(filter string) *Query {
+	decoder := json.NewDecoder(bytes.NewReader([]byte(filter)))
+	decoder.UseNumber()
+	var obj map[string]any
+	err := decoder.Decode(&obj)
+	if err == nil {
+		err = c.applyFilter(obj)
+	}
+	if err != nil && c.err == nil {
+		c.err = errors.New("filter: " + err.Error())
+	}
+	return c
+}
+
+// ToJSON 将查询条件序列化为 Json 格式的过滤条件，可以通过 FromJSON 还原
+// 使用了无法序列化的条件（Near、Within、Nearest）时返回错误
+func (c *Query) ToJSON() (string, error) {
+	if len(c.unserializable) > 0 {
+		return "", errors.New("filter: " + c.unserializable + " can not be serialized")
+	}
+	filter, ok := c.root().toFilter()
+	if !ok {
+		return "", errors.New("filter: expression can not be serialized")
+	}
+	bs, err := json.Marshal(filter)
+	if err != nil {
+		return "", err
+	}
+	return string(bs), nil
+}
+
+// 记录最后添加的条件对应的 Json 过滤条件，用于序列化
+func (c *Query) record(filter map[string]any) {
+	c.last().filter = filter
+}
+
+// 记录单个字段的运算条件
+func (c *Query) recordOp(field, operator string, value any) {
+	c.record(map[string]any{
+		field: map[string]any{
+			operator: value,
+		},
+	})
+}
+
+// 记录无法序列化的条件
+func (c *Query) opaque(method string) {
+	if len(c.unserializable) <= 0 {
+		c.unserializable = method
+	}
+}
+
+// 合并多个条件，字段冲突时使用 $and 连接
+func mergeFilters(filters []map[string]any) map[string]any {
+	out := make(map[string]any)
+	for _, filter := range filters {
+		for k, v := range filter {
+			old, ok := out[k]
+			if !ok {
+				out[k] = v
+				continue
+			}
+			// 同一个字段的不同运算符可以合并
+			om, isMap := old.(map[string]any)
+			nm, isNewMap := v.(map[string]any)
+			if !isMap || !isNewMap || k == opAnd || k == opOr || k == opNot || k == opWhere {
+				return map[string]any{
+					opAnd: filters,
+				}
+			}
+			merged := make(map[string]any)
+			for ok, ov := range om {
+				merged[ok] = ov
+			}
+			for nk, nv := range nm {
+				if _, exist := merged[nk]; exist {
+					return map[string]any{
+						opAnd: filters,
+					}
+				}
+				merged[nk] = nv
+			}
+			out[k] = merged
+		}
+	}
+	return out
+}
+
+func (c *Query) applyFilter(obj map[string]any) error {
+	for _, k := range sortedKeys(obj) {
+		v := obj[k]
+		switch k {
+		case opAnd:
+			list, err := toFilters(v)
+			if err != nil {
+				return err
+			}
+			for _, sub := range list {
+				if err = c.applyFilter(sub); err != nil {
+					return err
+				}
+			}
+		case opOr:
+			list, err := toFilters(v)
+			if err != nil {
+				return err
+			}
+			sc := Expr()
+			for _, sub := range list {
+				branch := Expr()
+				if err = branch.applyFilter(sub); err != nil {
+					return err
+				}
+				sc.Must(branch)
+			}
+			c.Should(sc)
+		case opNot:
+			sub, ok := v.(map[string]any)
+			if !ok {
+				return errors.New("$not requires an object")
+			}
+			sc := Expr()
+			if err := sc.applyFilter(sub); err != nil {
+				return err
+			}
+			c.Not(sc)
+		case opWhere:
+			where, ok := v.(map[string]any)
+			code, isString := where["expr"].(string)
+			if !ok || !isString {
+				return errors.New("$where requires expr")
+			}
+			params, _ := fromNumber(where["params"]).(map[string]any)
+			c.Where(code, params)
+		default:
+			// 以 $ 开头的 key 只能是逻辑运算符，拼写错误时不能当作字段名
+			if strings.HasPrefix(k, "$") {
+				return errors.New("unknown operator " + k)
+			}
+			if err := c.applyField(k, v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 将 Json 中的数字（包括对象及数组中的数字）还原为 float64
+func fromNumber(v any) any {
+	switch t := v.(type) {
+	case json.Number:
+		f, _ := t.Float64()
+		return f
+	case map[string]any:
+		for k, sub := range t {
+			t[k] = fromNumber(sub)
+		}
+	case []any:
+		for i, sub := range t {
+			t[i] = fromNumber(sub)
+		}
+	}
+	return v
+}
+
+func (c *Query) applyField(field string, v any) error {
+	if v == nil {
+		c.NotExist(field)
+		return nil
+	}
+	ops, ok := v.(map[string]any)
+	if !ok {
+		value, err := toScalar(v)
+		if err != nil {
+			return errors.New(field + ": " + err.Error())
+		}
+		c.Eq(field, value)
+		return nil
+	}
+	if from, to, hasFrom, hasTo, ok := toTimeRange(field, ops); ok {
+		c.between(field, from, to, hasFrom, hasTo)
+		return nil
+	}
+	for _, op := range sortedKeys(ops) {
+		if op == opIn || op == opNin {
+			values, err := toScalars(ops[op])
+			if err != nil {
+				return errors.New(field + "." + op + ": " + err.Error())
+			}
+			if op == opIn {
+				c.In(field, values...)
+			} else {
+				c.NotIn(field, values...)
+			}
+			continue
+		}
+		if op == opExists || op == opEmpty || op == opNumeric {
+			flag, ok := ops[op].(bool)
+			if !ok {
+				return errors.New(field + "." + op + ": value must be a boolean")
+			}
+			switch {
+			case op == opExists && flag:
+				c.Exist(field)
+			case op == opExists:
+				c.NotExist(field)
+			case op == opEmpty && flag:
+				c.IsEmpty(field)
+			case op == opEmpty:
+				c.Not(Expr().IsEmpty(field))
+			case flag:
+				c.IsNumeric(field)
+			default:
+				c.Not(Expr().IsNumeric(field))
+			}
+			continue
+		}
+		value, err := toScalar(ops[op])
+		if err != nil {
+			return errors.New(field + "." + op + ": " + err.Error())
+		}
+		switch op {
+		case opEq:
+			c.Eq(field, value)
+		case opNe:
+			c.Ne(field, value)
+		case opGt:
+			c.Gt(field, value)
+		case opGte:
+			c.Gte(field, value)
+		case opLt:
+			c.Lt(field, value)
+		case opLte:
+			c.Lte(field, value)
+		case opLike:
+			c.Like(field, value)
+		case opPrefix:
+			c.LeftLike(field, value)
+		case opSuffix:
+			c.RightLike(field, value)
+		case opEqFold:
+			c.EqFold(field, value)
+		case opPrefixFold:
+			c.PrefixFold(field, value)
+		case opRegex:
+			c.Regex(field, value)
+		case opBefore:
+			c.TimeBefore(field, value)
+		case opAfter:
+			c.TimeAfter(field, value)
+		default:
+			return errors.New(field + ": unknown operator " + op)
+		}
+	}
+	return nil
+}
+
+// 创建时间、更新时间的 $gte/$lte 毫秒时间戳条件，还原为时间区间查询以走时间索引
+func toTimeRange(field string, ops map[string]any) (from, to int64, hasFrom, hasTo, ok bool) {
+	if field != createdAt && field != updatedAt {
+		return 0, 0, false, false, false
+	}
+	for k, v := range ops {
+		n, isNumber := v.(json.Number)
+		if !isNumber {
+			return 0, 0, false, false, false
+		}
+		ms, err := n.Int64()
+		if err != nil {
+			return 0, 0, false, false, false
+		}
+		switch k {
+		case opGte:
+			from, hasFrom = ms, true
+		case opLte:
+			to, hasTo = ms, true
+		default:
+			return 0, 0, false, false, false
+		}
+	}
+	return from, to, hasFrom, hasTo, hasFrom || hasTo
+}
+
+func toFilters(v any) ([]map[string]any, error) {
+	list, ok := v.([]any)
+	if !ok {
+		return nil, errors.New("$and/$or requires an array")
+	}
+	var filters []map[string]any
+	for _, item := range list {
+		obj, ok := item.(map[string]any)
+		if !ok {
+			return nil, errors.New("$and/$or items must be objects")
+		}
+		filters = append(filters, obj)
+	}
+	return filters, nil
+}
+
+// 将字符串、数字、布尔值转换为字段值
+func toScalar(v any) (string, error) {
+	switch value := v.(type) {
+	case string:
+		return value, nil
+	case json.Number:
+		return value.String(), nil
+	case float64:
+		return toNumber(value), nil
+	case bool:
+		return strconv.FormatBool(value), nil
+	}
+	return "", errors.New("value must be a string, number or boolean")
+}
+
+func toScalars(v any) ([]string, error) {
+	list, ok := v.([]any)
+	if !ok {
+		return nil, errors.New("value must be an array")
+	}
+	var values []string
+	for _, item := range list {
+		s, err := toScalar(item)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, s)
+	}
+	return values, nil
+}
+
+// 序列化时数值条件尽量使用数字
+func toJSONNumber(value string) any {
+	if _, err := strconv.ParseFloat(value, 64); err == nil {
+		return json.Number(value)
+	}
+	return value
+}
+
+func sortedKeys(m map[string]any) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
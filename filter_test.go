@@ -0,0 +1,140 @@
+package kv2doc_test
+
+import (
+	"github.com/dpwgc/kv2doc"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func addBooks(t *testing.T, db *kv2doc.DB) {
+	t.Helper()
+	addDocs(t, db, "books",
+		kv2doc.Doc{"title": "Dune", "genre": "scifi", "year": "1965"},
+		kv2doc.Doc{"title": "Neuromancer", "genre": "scifi", "year": "1984"},
+		kv2doc.Doc{"title": "Emma", "genre": "novel", "year": "1815"},
+		kv2doc.Doc{"title": "Dracula", "genre": "horror", "year": "1897", "stock": "2"},
+		kv2doc.Doc{"title": "dune messiah", "genre": "scifi", "year": "1969", "stock": "0"},
+	)
+}
+
+func TestFind(t *testing.T) {
+	db, _ := newTestDB(t)
+	addBooks(t, db)
+
+	tests := []struct {
+		name   string
+		filter string
+		want   []string
+	}{
+		{"eq", `{"genre": "novel"}`, []string{"Emma"}},
+		{"eq operator", `{"genre": {"$eq": "horror"}}`, []string{"Dracula"}},
+		{"ne", `{"genre": {"$ne": "scifi"}}`, []string{"Dracula", "Emma"}},
+		// Json 数字按数值比较
+		{"range", `{"year": {"$gte": 1900, "$lt": 1969}}`, []string{"Dune"}},
+		{"in", `{"title": {"$in": ["Emma", "Dune", "Ulysses"]}}`, []string{"Dune", "Emma"}},
+		{"nin", `{"genre": {"$nin": ["scifi", "novel"]}}`, []string{"Dracula"}},
+		{"like", `{"title": {"$like": "man"}}`, []string{"Neuromancer"}},
+		{"prefix", `{"title": {"$prefix": "D"}}`, []string{"Dracula", "Dune"}},
+		{"suffix", `{"title": {"$suffix": "ah"}}`, []string{"dune messiah"}},
+		{"eq fold", `{"title": {"$eqFold": "DUNE"}}`, []string{"Dune"}},
+		{"prefix fold", `{"title": {"$prefixFold": "dun"}}`, []string{"Dune", "dune messiah"}},
+		{"exists", `{"stock": {"$exists": true}, "genre": "scifi"}`, []string{"dune messiah"}},
+		{"not exists", `{"stock": {"$exists": false}, "genre": "scifi"}`, []string{"Dune", "Neuromancer"}},
+		{"and or", `{"$or": [{"genre": "novel"}, {"$and": [{"genre": "scifi"}, {"year": {"$gt": 1966}}]}]}`, []string{"Emma", "Neuromancer", "dune messiah"}},
+		{"not", `{"$not": {"genre": "scifi"}}`, []string{"Dracula", "Emma"}},
+		{"nested not", `{"genre": "scifi", "$not": {"$or": [{"year": {"$lt": 1966}}, {"stock": {"$exists": true}}]}}`, []string{"Neuromancer"}},
+		{"where", `{"$where": {"expr": "float(year) < before", "params": {"before": 1900}}}`, []string{"Dracula", "Emma"}},
+		// 对象及数组中的数字同样按数值处理
+		{"where nested params", `{"$where": {"expr": "float(year) < range.to && float(year) in years", "params": {"range": {"to": 1970}, "years": [1815, 1965, 1984]}}}`, []string{"Dune", "Emma"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := db.Find("books", tt.filter)
+			if got := listTitles(t, query); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			// 序列化后还原，结果不变
+			s, err := query.ToJSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+			restored := db.Find("books", s)
+			if got := listTitles(t, restored); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("round trip through %s: got %v, want %v", s, got, tt.want)
+			}
+			// 再次序列化的结果不变
+			s2, err := restored.ToJSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s2 != s {
+				t.Errorf("ToJSON() = %s, want %s", s2, s)
+			}
+		})
+	}
+}
+
+// 通过查询方法构建的条件同样可以序列化
+func TestToJSON(t *testing.T) {
+	db, _ := newTestDB(t)
+	addBooks(t, db)
+
+	query := db.Query("books").Eq("genre", "scifi").Should(kv2doc.Expr().Lt("year", "1966").LeftLike("title", "dune"))
+	want := listTitles(t, query)
+	s, err := query.ToJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := listTitles(t, db.Find("books", s)); !reflect.DeepEqual(got, want) || len(got) != 2 {
+		t.Errorf("Find(%s) = %v, want %v", s, got, want)
+	}
+}
+
+func TestFindErrors(t *testing.T) {
+	db, _ := newTestDB(t)
+	addBooks(t, db)
+
+	tests := []struct {
+		name  string
+		query *kv2doc.Query
+		// ToJSON 出错，否则为执行查询出错
+		serialize bool
+	}{
+		{"invalid json", db.Find("books", `{"genre": `), false},
+		{"unknown operator", db.Find("books", `{"genre": {"$foo": "1"}}`), false},
+		{"unknown top level operator", db.Find("books", `{"$nor": [{"genre": "novel"}]}`), false},
+		{"or not array", db.Find("books", `{"$or": {"genre": "novel"}}`), false},
+		{"not not object", db.Find("books", `{"$not": [{"genre": "novel"}]}`), false},
+		{"where without expr", db.Find("books", `{"$where": {"params": {}}}`), false},
+		{"near", db.Query("books").Near("location", 30, 120, 1000), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.serialize {
+				if _, err := tt.query.ToJSON(); err == nil {
+					t.Error("ToJSON() returned no error")
+				}
+				return
+			}
+			if _, err := tt.query.List(); err == nil {
+				t.Error("List() returned no error")
+			}
+		})
+	}
+}
+
+// 返回排序后的书名
+func listTitles(t *testing.T, query *kv2doc.Query) []string {
+	t.Helper()
+	docs, err := query.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var titles []string
+	for _, v := range docs {
+		titles = append(titles, v["title"])
+	}
+	sort.Strings(titles)
+	return titles
+}
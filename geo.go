@@ -0,0 +1,278 @@
+package kv2doc
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	geoPrefix = "g"
+	// geohash 索引精度
+	geoPrecision = 12
+	// 地球半径（米）
+	earthRadius = 6371008.8
+	// 覆盖查询范围时最多使用的 geohash 格子数量
+	geoCells = 16
+)
+
+const geoBase32 = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// Point 地理坐标
+type Point struct {
+	Lat float64
+	Lng float64
+}
+
+func (c Point) String() string {
+	return strconv.FormatFloat(c.Lat, 'f', -1, 64) + "," + strconv.FormatFloat(c.Lng, 'f', -1, 64)
+}
+
+// 解析 "纬度,经度" 格式的字段值
+func toPoint(s string) (Point, bool) {
+	i := strings.Index(s, ",")
+	if i < 0 {
+		return Point{}, false
+	}
+	lat, err := strconv.ParseFloat(strings.TrimSpace(s[:i]), 64)
+	if err != nil || lat < -90 || lat > 90 {
+		return Point{}, false
+	}
+	lng, err := strconv.ParseFloat(strings.TrimSpace(s[i+1:]), 64)
+	if err != nil || lng < -180 || lng > 180 {
+		return Point{}, false
+	}
+	return Point{Lat: lat, Lng: lng}, true
+}
+
+// Distance 计算两个坐标之间的球面距离（米）
+func Distance(a, b Point) float64 {
+	lat1 := a.Lat * math.Pi / 180
+	lat2 := b.Lat * math.Pi / 180
+	dLat := lat2 - lat1
+	dLng := (b.Lng - a.Lng) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// 判断坐标是否在多边形内（射线法），只有两个点时视为矩形的两个对角
+func inPolygon(p Point, polygon []Point) bool {
+	if len(polygon) == 2 {
+		minLat, maxLat := math.Min(polygon[0].Lat, polygon[1].Lat), math.Max(polygon[0].Lat, polygon[1].Lat)
+		minLng, maxLng := math.Min(polygon[0].Lng, polygon[1].Lng), math.Max(polygon[0].Lng, polygon[1].Lng)
+		return p.Lat >= minLat && p.Lat <= maxLat && p.Lng >= minLng && p.Lng <= maxLng
+	}
+	in := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		a, b := polygon[i], polygon[j]
+		if (a.Lat > p.Lat) != (b.Lat > p.Lat) && p.Lng < (b.Lng-a.Lng)*(p.Lat-a.Lat)/(b.Lat-a.Lat)+a.Lng {
+			in = !in
+		}
+	}
+	return in
+}
+
+// 计算坐标的 geohash 编码
+func geohash(p Point, precision int) string {
+	minLat, maxLat := -90.0, 90.0
+	minLng, maxLng := -180.0, 180.0
+	var sb strings.Builder
+	bit, ch, even := 0, 0, true
+	for sb.Len() < precision {
+		if even {
+			mid := (minLng + maxLng) / 2
+			if p.Lng >= mid {
+				ch |= 1 << (4 - bit)
+				minLng = mid
+			} else {
+				maxLng = mid
+			}
+		} else {
+			mid := (minLat + maxLat) / 2
+			if p.Lat >= mid {
+				ch |= 1 << (4 - bit)
+				minLat = mid
+			} else {
+				maxLat = mid
+			}
+		}
+		even = !even
+		if bit < 4 {
+			bit++
+		} else {
+			sb.WriteByte(geoBase32[ch])
+			bit, ch = 0, 0
+		}
+	}
+	return sb.String()
+}
+
+// 指定精度下 geohash 格子的高度和宽度（度）
+func geoCellSize(precision int) (lat, lng float64) {
+	bits := 5 * precision
+	return 180 / math.Pow(2, float64(bits/2)), 360 / math.Pow(2, float64(bits-bits/2))
+}
+
+// 计算覆盖矩形范围的 geohash 格子，格子数量不超过 geoCells 个
+func geoCover(sw, ne Point) []string {
+	sw.Lat, ne.Lat = math.Max(sw.Lat, -90), math.Min(ne.Lat, 90)
+	precision := 1
+	for p := geoPrecision; p > 1; p-- {
+		h, w := geoCellSize(p)
+		rows := math.Floor(ne.Lat/h) - math.Floor(sw.Lat/h) + 1
+		cols := math.Floor(ne.Lng/w) - math.Floor(sw.Lng/w) + 1
+		if rows*cols <= geoCells {
+			precision = p
+			break
+		}
+	}
+	h, w := geoCellSize(precision)
+	var cells []string
+	seen := make(map[string]bool)
+	for lat := sw.Lat; ; lat += h {
+		if lat > ne.Lat {
+			lat = ne.Lat
+		}
+		for lng := sw.Lng; ; lng += w {
+			if lng > ne.Lng {
+				lng = ne.Lng
+			}
+			// 跨越 180 度经线时折回
+			p := Point{Lat: lat, Lng: lng}
+			if p.Lng >= 180 {
+				p.Lng -= 360
+			} else if p.Lng < -180 {
+				p.Lng += 360
+			}
+			cell := geohash(p, precision)
+			if !seen[cell] {
+				seen[cell] = true
+				cells = append(cells, cell)
+			}
+			if lng >= ne.Lng {
+				break
+			}
+		}
+		if lat >= ne.Lat {
+			break
+		}
+	}
+	return cells
+}
+
+// 计算圆形范围的外接矩形
+func geoBound(center Point, radius float64) (sw, ne Point) {
+	dLat := radius / earthRadius * 180 / math.Pi
+	dLng := 360.0
+	if cos := math.Cos(center.Lat * math.Pi / 180); cos > 1e-9 {
+		dLng = math.Min(dLat/cos, 180)
+	}
+	return Point{Lat: center.Lat - dLat, Lng: center.Lng - dLng}, Point{Lat: center.Lat + dLat, Lng: center.Lng + dLng}
+}
+
+// Near 距离指定坐标不超过 radius 米，会走地理位置索引（需要先用 Define 将字段定义为 Geo 类型）
+// 没有指定排序规则时，结果按距离由近到远排序
+func (c *Query) Near(field string, lat, lng, radius float64) *Query {
+	center := Point{Lat: lat, Lng: lng}
+	c.add(`(geoDistance(` + toField(field) + `, ` + toFloat(lat) + `, ` + toFloat(lng) + `) <= ` + toFloat(radius) + `)`)
+	c.opaque("Near")
+	sw, ne := geoBound(center, radius)
+	c.selectGeoIndex(field, geoCover(sw, ne))
+	if !c.isChild && c.sort == nil {
+		c.sort = func(l, r Doc) bool {
+			lp, _ := toPoint(l[field])
+			rp, _ := toPoint(r[field])
+			return Distance(lp, center) < Distance(rp, center)
+		}
+	}
+	return c
+}
+
+// Within 位于指定范围内，传入两个坐标时表示矩形（西南角和东北角），传入三个及以上坐标时表示多边形
+// 会走地理位置索引（需要先用 Define 将字段定义为 Geo 类型）
+func (c *Query) Within(field string, points ...Point) *Query {
+	c.opaque("Within")
+	if len(points) < 2 {
+		c.add(`(false)`)
+		return c
+	}
+	var ps []string
+	sw, ne := points[0], points[0]
+	for _, v := range points {
+		ps = append(ps, v.String())
+		sw.Lat, sw.Lng = math.Min(sw.Lat, v.Lat), math.Min(sw.Lng, v.Lng)
+		ne.Lat, ne.Lng = math.Max(ne.Lat, v.Lat), math.Max(ne.Lng, v.Lng)
+	}
+	c.add(`(geoWithin(` + toField(field) + `, ` + c.bind(strings.Join(ps, ";")) + `) == true)`)
+	c.selectGeoIndex(field, geoCover(sw, ne))
+	return c
+}
+
+// 字段是否定义为地理位置字段（只有地理位置字段才有 geohash 索引）
+func (c *DB) isGeo(table, field string) bool {
+	schema, err := c.schema(table)
+	return err == nil && schema[field].Type == Geo
+}
+
+func (c *Query) selectGeoIndex(field string, cells []string) {
+	if len(field) <= 0 || len(cells) <= 0 {
+		return
+	}
+	index := Index{
+		field:    field,
+		operator: geo,
+	}
+	for _, v := range cells {
+		index.union = append(index.union, Index{
+			field:    field,
+			value:    v,
+			operator: geo,
+		})
+	}
+	c.last().indexes = append(c.last().indexes, index)
+}
+
+// 表达式中使用的地理位置函数
+func geoDistance(params ...any) (any, error) {
+	if len(params) != 3 {
+		return nil, errors.New("geoDistance: wrong number of arguments")
+	}
+	p, ok := toPoint(fmt.Sprint(params[0]))
+	if !ok {
+		return nil, errors.New("geoDistance: invalid point")
+	}
+	lat, err := strconv.ParseFloat(fmt.Sprint(params[1]), 64)
+	if err != nil {
+		return nil, err
+	}
+	lng, err := strconv.ParseFloat(fmt.Sprint(params[2]), 64)
+	if err != nil {
+		return nil, err
+	}
+	return Distance(p, Point{Lat: lat, Lng: lng}), nil
+}
+
+func geoWithin(params ...any) (any, error) {
+	if len(params) != 2 {
+		return nil, errors.New("geoWithin: wrong number of arguments")
+	}
+	p, ok := toPoint(fmt.Sprint(params[0]))
+	if !ok {
+		return nil, errors.New("geoWithin: invalid point")
+	}
+	var polygon []Point
+	for _, v := range strings.Split(fmt.Sprint(params[1]), ";") {
+		vp, ok := toPoint(v)
+		if !ok {
+			return nil, errors.New("geoWithin: invalid polygon")
+		}
+		polygon = append(polygon, vp)
+	}
+	return inPolygon(p, polygon), nil
+}
+
+func toFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -0,0 +1,499 @@
+package kv2doc
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"github.com/dpwgc/kv2doc/store"
+	"runtime"
+	"sync"
+)
+
+// 游标每次从存储中读取的 key 数量
+const iterBatch = 100
+
+// Cursor 查询游标，通过 Next 逐个拉取文档，使用完毕后必须调用 Close
+//
+//	cursor := db.Query("test_table").Eq("type", "1").Iter()
+//	defer cursor.Close()
+//	for cursor.Next() {
+//		fmt.Println(cursor.Doc())
+//	}
+//	if err := cursor.Err(); err != nil {
+//		...
+//	}
+type Cursor struct {
+	// 读取下一个文档，没有更多文档时返回 nil
+	next  func() (Doc, error)
+	state *iterState
+	doc   Doc
+	err   error
+}
+
+// 游标持有的资源，与 Cursor 分开保存，使得未关闭的游标可以被回收并由 finalizer 释放
+type iterState struct {
+	snapshot store.Snapshot
+	cancel   context.CancelFunc
+}
+
+// Iter 返回查询游标，按需拉取文档，不会一次性把全部文档加载进内存
+// 第一次调用 Next 时开启存储的只读快照（存储引擎实现了 store.Viewer 时），游标关闭或遍历结束前一直持有该读事务，遍历过程中读到的数据不受之后写入的影响
+// 没有排序规则时在快照中逐批读取索引或文档的 key，不使用后台协程；Bolt 持有读事务时数据库文件无法扩容，遍历期间不要在同一个协程中写入数据
+// 有排序规则时，第一次调用 Next 会在快照中完成扫描并排序，随后释放读事务，设置了 Limit 时只在内存中保留排在前面的 cursor+size 个文档
+func (c *Query) Iter() *Cursor {
+	state := &iterState{}
+	cursor := &Cursor{
+		state: state,
+	}
+	if c.isChild {
+		cursor.next = func() (Doc, error) {
+			return nil, nil
+		}
+		return cursor
+	}
+	cursor.next = c.iterate(state)
+	// 没有调用 Close 的游标被回收时释放读事务
+	runtime.SetFinalizer(cursor, (*Cursor).Close)
+	return cursor
+}
+
+// IterCtx 返回查询游标，ctx 取消或超时后中断扫描，Err 返回 ctx.Err()
+func (c *Query) IterCtx(ctx context.Context) *Cursor {
+	cc := *c
+	cc.ctx = ctx
+	return cc.Iter()
+}
+
+// Next 拉取下一个文档，没有更多文档或者出错时返回 false，并释放读事务
+func (c *Cursor) Next() bool {
+	if c.next == nil {
+		c.doc = nil
+		return false
+	}
+	c.doc, c.err = c.next()
+	if c.doc == nil {
+		c.next = nil
+		if err := c.state.release(); c.err == nil {
+			c.err = err
+		}
+		return false
+	}
+	return true
+}
+
+// Doc 当前文档
+func (c *Cursor) Doc() Doc {
+	return c.doc
+}
+
+// Err 遍历过程中出现的错误，在 Next 返回 false 后调用
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// Close 结束遍历并释放读事务，可以重复调用
+func (c *Cursor) Close() error {
+	c.next = nil
+	c.doc = nil
+	runtime.SetFinalizer(c, nil)
+	return c.state.release()
+}
+
+func (c *iterState) release() (err error) {
+	if c.snapshot != nil {
+		err = c.snapshot.Close()
+		c.snapshot = nil
+	}
+	if c.cancel != nil {
+		c.cancel()
+		c.cancel = nil
+	}
+	return err
+}
+
+// 第一次读取时开启快照，之后逐个返回文档
+func (c Query) iterate(state *iterState) func() (Doc, error) {
+	var next func() (Doc, error)
+	return func() (Doc, error) {
+		if next == nil {
+			var err error
+			next, err = c.open(state)
+			if err != nil {
+				next = func() (Doc, error) {
+					return nil, nil
+				}
+				return nil, err
+			}
+		}
+		return next()
+	}
+}
+
+func (c Query) open(state *iterState) (func() (Doc, error), error) {
+	if len(c.table) <= 0 || c.db == nil {
+		return nil, errors.New("parameter error")
+	}
+	// 从第一次读取时开始计时
+	c, state.cancel = c.withContext()
+	db, snapshot, err := c.db.view()
+	if err != nil {
+		return nil, err
+	}
+	state.snapshot = snapshot
+	c.db = db
+	if c.sort == nil && c.nearest == nil {
+		return c.stream()
+	}
+	docs, err := c.top()
+	if err != nil {
+		return nil, err
+	}
+	// 排序结果已经全部读取，不再需要读事务
+	if err = state.release(); err != nil {
+		return nil, err
+	}
+	return func() (Doc, error) {
+		if len(docs) <= 0 {
+			return nil, nil
+		}
+		doc := docs[0]
+		docs = docs[1:]
+		return doc, nil
+	}, nil
+}
+
+// 基于只读快照的数据库，所有读取都在快照中完成，存储引擎没有实现 store.Viewer 时直接读取存储
+func (c *DB) view() (*DB, store.Snapshot, error) {
+	viewer, ok := c.store.(store.Viewer)
+	if !ok {
+		return c, nil, nil
+	}
+	snapshot, err := viewer.View()
+	if err != nil {
+		return nil, nil, err
+	}
+	db := *c
+	db.store = snapshotStore{snapshot}
+	// 快照中读到的字段定义及聚类中心不写入共享的缓存
+	db.schemas = &sync.Map{}
+	db.centroids = &sync.Map{}
+	return &db, snapshot, nil
+}
+
+// 快照上的只读存储
+type snapshotStore struct {
+	store.Snapshot
+}
+
+func (c snapshotStore) CreateTable(table string) error {
+	return errReadOnly
+}
+
+func (c snapshotStore) DropTable(table string) error {
+	return errReadOnly
+}
+
+func (c snapshotStore) SetKV(table string, kvs []store.KV) error {
+	return errReadOnly
+}
+
+func (c snapshotStore) NextID(table string) (string, error) {
+	return "", errReadOnly
+}
+
+var errReadOnly = errors.New("snapshot is read only")
+
+// 按执行计划逐个读取满足条件的文档，每次从存储中读取一批 key，只保留当前这一批
+func (c Query) stream() (func() (Doc, error), error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	match, err := c.matcher()
+	if err != nil {
+		return nil, err
+	}
+	guard := &scanGuard{
+		ctx: c.ctx,
+		max: c.maxScanned,
+	}
+	plan, _ := c.db.plan(c)
+	// 估算代价时查询可能已经取消或超时
+	if err = guard.err(); err != nil {
+		return nil, err
+	}
+	var source func() (Doc, error)
+	if plan.Access == accessScan {
+		source = c.scanSource(guard)
+	} else {
+		source = c.indexSource(plan.Indexes, guard)
+	}
+	skipped, sent := 0, 0
+	cache := make(map[string][]Doc)
+	return func() (Doc, error) {
+		for !c.limit.enable || sent < c.limit.size {
+			doc, err := source()
+			if err != nil || doc == nil {
+				return nil, err
+			}
+			ok, err := match(doc)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+			if c.limit.enable && skipped < c.limit.cursor {
+				skipped++
+				continue
+			}
+			sent++
+			if err = c.join(doc, cache); err != nil {
+				return nil, err
+			}
+			return c.project(doc), nil
+		}
+		return nil, nil
+	}, nil
+}
+
+// 按主键顺序逐个读取文档
+func (c Query) scanSource(guard *scanGuard) func() (Doc, error) {
+	start := toPath(primaryPrefix, primaryKey, "")
+	if len(c.start) > 0 {
+		// 从指定主键之后开始扫描
+		start = toPath(primaryPrefix, primaryKey, c.start) + "\x00"
+	}
+	keys := &keyIter{
+		db:    c.db,
+		table: c.table,
+		start: start,
+		end:   toPath(primaryPrefix, primaryKey) + "0",
+	}
+	return func() (Doc, error) {
+		kv, ok, err := keys.next()
+		if err != nil || !ok {
+			return nil, err
+		}
+		if err = guard.check(); err != nil {
+			return nil, err
+		}
+		return Doc{}.FromBytes(kv.Value), nil
+	}
+}
+
+// 依次扫描第一个索引的各个分支，按主键读取文档
+// 多个分支取并集时，跳过之前的分支中已经出现过的文档；多个索引取交集时，先用其余索引的 key 排除一定不满足条件的主键
+func (c Query) indexSource(indexes []Index, guard *scanGuard) func() (Doc, error) {
+	leaves := indexes[0].leaves()
+	i := 0
+	var keys *keyIter
+	return func() (Doc, error) {
+		for i < len(leaves) {
+			if keys == nil {
+				start, end := leaves[i].bounds()
+				keys = &keyIter{
+					db:    c.db,
+					table: c.table,
+					start: start,
+					end:   end,
+				}
+			}
+			kv, ok, err := keys.next()
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				i++
+				keys = nil
+				continue
+			}
+			if err = guard.check(); err != nil {
+				return nil, err
+			}
+			id := toID(kv.Value)
+			ok, err = c.db.mayContain(c.table, indexes[1:], id)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+			kv, err = c.db.store.GetKV(c.table, toPath(primaryPrefix, primaryKey, id))
+			if err != nil {
+				return nil, err
+			}
+			if !kv.HasValue() {
+				continue
+			}
+			doc := Doc{}.FromBytes(kv.Value)
+			if i > 0 {
+				seen, err := c.db.inLeaves(c.table, doc, leaves[:i])
+				if err != nil {
+					return nil, err
+				}
+				if seen {
+					continue
+				}
+			}
+			return doc, nil
+		}
+		return nil, nil
+	}
+}
+
+// 主键是否可能出现在每个索引中，只检查 key 中带有完整字段值的索引，其他索引交给查询条件筛选
+func (c *DB) mayContain(table string, indexes []Index, id string) (bool, error) {
+	for _, index := range indexes {
+		found := false
+		for _, leaf := range index.leaves() {
+			if leaf.operator != eq && leaf.operator != eqFold && leaf.operator != vector {
+				found = true
+				break
+			}
+			kv, err := c.store.GetKV(table, leaf.prefix()+id)
+			if err != nil {
+				return false, err
+			}
+			if kv.HasValue() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// 文档的索引 key 是否落在任意一个分支的扫描区间内
+func (c *DB) inLeaves(table string, doc Doc, leaves []Index) (bool, error) {
+	kvs, err := c.indexKVs(table, doc)
+	if err != nil {
+		return false, err
+	}
+	for _, kv := range kvs {
+		for _, leaf := range leaves {
+			start, end := leaf.bounds()
+			if kv.Key >= start && kv.Key < end {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// 索引分支的扫描区间（包含 start，不包含 end）
+func (c Index) bounds() (start, end string) {
+	if c.ranged() {
+		return c.value, c.end
+	}
+	prefix := c.prefix()
+	return prefix, prefixEnd(prefix)
+}
+
+// 以指定前缀开头的 key 的上界：前缀最后一个小于 0xff 的字节加一
+func prefixEnd(prefix string) string {
+	bs := []byte(prefix)
+	for i := len(bs) - 1; i >= 0; i-- {
+		if bs[i] < 0xff {
+			bs[i]++
+			return string(bs[:i+1])
+		}
+	}
+	return ""
+}
+
+// 在区间 [start, end) 内按顺序逐个读取 key，每次从存储中读取 iterBatch 个，下一批从上一批最后一个 key 之后继续
+type keyIter struct {
+	db    *DB
+	table string
+	start string
+	end   string
+	kvs   []store.KV
+	done  bool
+}
+
+func (c *keyIter) next() (kv store.KV, ok bool, err error) {
+	if len(c.kvs) <= 0 && !c.done {
+		err = c.db.rangeKV(c.table, c.start, c.end, func(key string, value []byte) bool {
+			// 没有快照时读事务已经结束，需要复制 value
+			c.kvs = append(c.kvs, store.KV{
+				Key:   key,
+				Value: append([]byte{}, value...),
+			})
+			return len(c.kvs) < iterBatch
+		})
+		if err != nil {
+			return store.KV{}, false, err
+		}
+		c.done = len(c.kvs) < iterBatch
+		if len(c.kvs) > 0 {
+			c.start = c.kvs[len(c.kvs)-1].Key + "\x00"
+		}
+	}
+	if len(c.kvs) <= 0 {
+		return store.KV{}, false, nil
+	}
+	kv = c.kvs[0]
+	c.kvs = c.kvs[1:]
+	return kv, true, nil
+}
+
+// 按排序规则返回文档，设置了 Limit 时扫描过程中只保留排在前面的 cursor+size 个文档
+func (c *Query) top() ([]Doc, error) {
+	if c.nearest != nil || !c.limit.enable {
+		_, docs, err := query(*c, false)
+		return docs, err
+	}
+	cc, cancel := c.withContext()
+	defer cancel()
+	n := cc.limit.cursor + cc.limit.size
+	h := &sortHeap{
+		less: cc.sort,
+	}
+	err := scan(cc, func(doc Doc) bool {
+		if h.Len() < n {
+			heap.Push(h, doc)
+		} else if n > 0 && cc.sort(doc, h.docs[0]) {
+			h.docs[0] = doc
+			heap.Fix(h, 0)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	docs := h.docs
+	if err = sortCtx(cc.ctx, docs, cc.sort); err != nil {
+		return nil, err
+	}
+	if len(docs) <= cc.limit.cursor {
+		return nil, nil
+	}
+	docs = docs[cc.limit.cursor:]
+	if err = cc.attach(docs); err != nil {
+		return nil, err
+	}
+	for i, v := range docs {
+		docs[i] = cc.project(v)
+	}
+	return docs, nil
+}
+
+// 按排序规则的大顶堆，堆顶是当前排在最后的文档
+type sortHeap struct {
+	less func(l, r Doc) bool
+	docs []Doc
+}
+
+func (h *sortHeap) Len() int           { return len(h.docs) }
+func (h *sortHeap) Less(i, j int) bool { return h.less(h.docs[j], h.docs[i]) }
+func (h *sortHeap) Swap(i, j int)      { h.docs[i], h.docs[j] = h.docs[j], h.docs[i] }
+func (h *sortHeap) Push(x any)         { h.docs = append(h.docs, x.(Doc)) }
+func (h *sortHeap) Pop() any {
+	old := h.docs
+	item := old[len(old)-1]
+	h.docs = old[:len(old)-1]
+	return item
+}
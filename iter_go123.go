@@ -0,0 +1,26 @@
+//go:build go1.23
+
+package kv2doc
+
+import "iter"
+
+// All 以 iter.Seq2 的形式遍历查询结果，可以直接用于 for range，提前退出循环时会自动关闭游标
+// 出错时最后一次迭代返回 nil 文档及错误
+//
+//	for doc, err := range db.Query("test_table").Eq("type", "1").All() {
+//		...
+//	}
+func (c *Query) All() iter.Seq2[Doc, error] {
+	return func(yield func(Doc, error) bool) {
+		cursor := c.Iter()
+		defer cursor.Close()
+		for cursor.Next() {
+			if !yield(cursor.Doc(), nil) {
+				return
+			}
+		}
+		if err := cursor.Err(); err != nil {
+			yield(nil, err)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+//go:build go1.23
+
+package kv2doc_test
+
+import (
+	"github.com/dpwgc/kv2doc"
+	"reflect"
+	"testing"
+)
+
+func TestAll(t *testing.T) {
+	db, _ := newTestDB(t)
+	addPosts(t, db, 30)
+
+	for _, query := range []func() *kv2doc.Query{
+		func() *kv2doc.Query { return db.Query("posts").Eq("author", "user4") },
+		func() *kv2doc.Query { return db.Query("posts").Desc("likes").Limit(2, 5) },
+	} {
+		want, err := query().List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []kv2doc.Doc
+		for doc, err := range query().All() {
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, doc)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("All returned %v, List returned %v", toIDs(got), toIDs(want))
+		}
+	}
+
+	// 提前退出循环时自动关闭游标，之后可以正常写入
+	n := 0
+	for _, err := range db.Query("posts").All() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n++; n >= 3 {
+			break
+		}
+	}
+	addPosts(t, db, 1)
+	if count, err := db.Query("posts").Count(); err != nil || count != 31 {
+		t.Errorf("Count() = %d, %v, want 31", count, err)
+	}
+}
@@ -0,0 +1,191 @@
+package kv2doc_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dpwgc/kv2doc"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func addPosts(t *testing.T, db *kv2doc.DB, n int) {
+	t.Helper()
+	bulk := db.Bulk("posts")
+	for i := 0; i < n; i++ {
+		bulk.Add(kv2doc.Doc{"author": fmt.Sprint("user", i%7), "tag": fmt.Sprint("t", i%5), "likes": fmt.Sprint(i * 37 % 101)})
+	}
+	if _, err := bulk.Exec(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCursor(t *testing.T) {
+	db, _ := newTestDB(t)
+	addPosts(t, db, 250)
+
+	tests := []struct {
+		name  string
+		query func() *kv2doc.Query
+	}{
+		{"scan", func() *kv2doc.Query { return db.Query("posts").Gt("likes", "10") }},
+		{"scan with limit", func() *kv2doc.Query { return db.Query("posts").Gt("likes", "10").Limit(120, 100) }},
+		{"index", func() *kv2doc.Query { return db.Query("posts").Eq("author", "user3") }},
+		{"index with limit", func() *kv2doc.Query { return db.Query("posts").Eq("author", "user3").Limit(5, 10) }},
+		{"in", func() *kv2doc.Query { return db.Query("posts").In("author", "user1", "user6", "nobody") }},
+		{"intersect", func() *kv2doc.Query { return db.Query("posts").Eq("author", "user3").Eq("tag", "t1") }},
+		// 两个分支有重复的文档
+		{"union", func() *kv2doc.Query {
+			return db.Query("posts").Should(kv2doc.Expr().Eq("author", "user3").Eq("tag", "t1"))
+		}},
+		{"sorted", func() *kv2doc.Query { return db.Query("posts").Eq("author", "user2").Desc("likes").Limit(3, 20) }},
+		{"sorted without limit", func() *kv2doc.Query { return db.Query("posts").Asc("likes") }},
+		{"select", func() *kv2doc.Query { return db.Query("posts").Eq("author", "user0").Select("likes") }},
+		{"empty limit", func() *kv2doc.Query { return db.Query("posts").Limit(0, 0) }},
+		{"no match", func() *kv2doc.Query { return db.Query("posts").Eq("author", "nobody") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want, err := tt.query().List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			cursor := tt.query().Iter()
+			var got []kv2doc.Doc
+			for cursor.Next() {
+				got = append(got, cursor.Doc())
+			}
+			if err = cursor.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if err = cursor.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(want) || (len(want) > 0 && !reflect.DeepEqual(got, want)) {
+				t.Errorf("Iter returned %v, List returned %v", toIDs(got), toIDs(want))
+			}
+		})
+	}
+}
+
+func TestCursorClose(t *testing.T) {
+	db, _ := newTestDB(t)
+	addPosts(t, db, 250)
+
+	for _, query := range []*kv2doc.Query{db.Query("posts"), db.Query("posts").Eq("author", "user1"), db.Query("posts").Asc("likes")} {
+		cursor := query.Iter()
+		if !cursor.Next() {
+			t.Fatalf("Next() = false, err = %v", cursor.Err())
+		}
+		if err := cursor.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if cursor.Next() {
+			t.Error("Next() = true after Close")
+		}
+		if cursor.Doc() != nil {
+			t.Errorf("Doc() = %v after Close", cursor.Doc())
+		}
+		if err := cursor.Err(); err != nil {
+			t.Errorf("Err() = %v after Close", err)
+		}
+		// 可以重复关闭
+		if err := cursor.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// 遍历期间其他协程的写入对游标不可见
+func TestCursorSnapshot(t *testing.T) {
+	for _, name := range []string{"scan", "index"} {
+		t.Run(name, func(t *testing.T) {
+			db, _ := newTestDB(t)
+			addPosts(t, db, 250)
+			query := func() *kv2doc.Query { return db.Query("posts") }
+			if name == "index" {
+				query = func() *kv2doc.Query { return db.Query("posts").Eq("tag", "t2") }
+			}
+			want, err := query().List()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cursor := query().Iter()
+			defer cursor.Close()
+			var got []kv2doc.Doc
+			if cursor.Next() {
+				got = append(got, cursor.Doc())
+			}
+			done := make(chan error, 1)
+			go func() {
+				_, err := query().Delete()
+				done <- err
+			}()
+			// Bolt 需要扩容时写入会等待游标关闭，最多等待 200 毫秒
+			select {
+			case err = <-done:
+				if err != nil {
+					t.Fatal(err)
+				}
+				done <- nil
+			case <-time.After(200 * time.Millisecond):
+			}
+			for cursor.Next() {
+				got = append(got, cursor.Doc())
+			}
+			if err = cursor.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Iter returned %v, want %v", toIDs(got), toIDs(want))
+			}
+			if err = <-done; err != nil {
+				t.Fatal(err)
+			}
+			if count, err := query().Count(); err != nil || count != 0 {
+				t.Errorf("Count() = %d, %v, want 0", count, err)
+			}
+		})
+	}
+}
+
+func TestCursorErr(t *testing.T) {
+	db, _ := newTestDB(t)
+	addPosts(t, db, 250)
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name   string
+		cursor func() *kv2doc.Cursor
+		want   error
+	}{
+		{"canceled", func() *kv2doc.Cursor { return db.Query("posts").IterCtx(canceled) }, context.Canceled},
+		{"canceled sorted", func() *kv2doc.Cursor { return db.Query("posts").Asc("likes").IterCtx(canceled) }, context.Canceled},
+		{"max scanned", func() *kv2doc.Cursor { return db.Query("posts").Gt("likes", "-1").MaxScanned(150).Iter() }, nil},
+		{"invalid filter", func() *kv2doc.Cursor { return db.Find("posts", `{"likes": {"$foo": 1}}`).Iter() }, nil},
+		{"strict", func() *kv2doc.Cursor { return db.Query("posts").Gt("missing", "1").Strict().Iter() }, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cursor := tt.cursor()
+			defer cursor.Close()
+			for cursor.Next() {
+			}
+			err := cursor.Err()
+			if err == nil {
+				t.Fatal("Err() = nil")
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("Err() = %v, want %v", err, tt.want)
+			}
+			// 出错后不再返回文档
+			if cursor.Next() {
+				t.Error("Next() = true after error")
+			}
+		})
+	}
+}
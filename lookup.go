@@ -0,0 +1,118 @@
+package kv2doc
+
+import "encoding/json"
+
+type lookup struct {
+	table   string
+	local   string
+	foreign string
+	as      string
+	inner   bool
+}
+
+// Lookup 关联查询（左连接），在 as 字段中以 Json 数组的形式附加另一张表中 foreignField 等于当前文档 localField 的文档
+// 没有匹配的文档时 as 字段为 []，关联查询会走另一张表 foreignField 字段的索引
+func (c *Query) Lookup(foreignTable, localField, foreignField, as string) *Query {
+	return c.lookup(foreignTable, localField, foreignField, as, false)
+}
+
+// InnerLookup 关联查询（内连接），与 Lookup 相同，但没有匹配文档的文档不会返回
+func (c *Query) InnerLookup(foreignTable, localField, foreignField, as string) *Query {
+	return c.lookup(foreignTable, localField, foreignField, as, true)
+}
+
+func (c *Query) lookup(foreignTable, localField, foreignField, as string, inner bool) *Query {
+	if c.isChild || len(foreignTable) <= 0 || len(localField) <= 0 || len(foreignField) <= 0 {
+		return c
+	}
+	if len(as) <= 0 {
+		as = foreignTable
+	}
+	c.lookups = append(c.lookups, lookup{
+		table:   foreignTable,
+		local:   localField,
+		foreign: foreignField,
+		as:      as,
+		inner:   inner,
+	})
+	return c
+}
+
+// 内连接是否有匹配的文档，扫描时只用它决定文档是否返回，不读取完整的关联结果
+// cache 缓存同一次查询中已经查过的字段值
+func (c *Query) exists(doc Doc, cache map[string]bool) (bool, error) {
+	for _, v := range c.lookups {
+		if !v.inner {
+			continue
+		}
+		value := doc[v.local]
+		if len(value) <= 0 {
+			return false, nil
+		}
+		key := toPath(v.table, v.foreign, value)
+		ok, seen := cache[key]
+		if !seen {
+			foreign := c.db.Query(v.table).Eq(v.foreign, value)
+			foreign.ctx = c.ctx
+			// 读到第一个匹配的文档就结束
+			err := foreign.Scroll(func(doc Doc) bool {
+				ok = true
+				return false
+			})
+			if err != nil {
+				return false, err
+			}
+			cache[key] = ok
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// 为排序分页之后返回的文档附加关联的文档
+func (c *Query) attach(docs []Doc) error {
+	if len(c.lookups) <= 0 {
+		return nil
+	}
+	cache := make(map[string][]Doc)
+	for _, v := range docs {
+		if err := c.join(v, cache); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 为文档附加关联的文档，cache 缓存同一次查询中已经查过的关联结果，避免相同的字段值重复查询
+func (c *Query) join(doc Doc, cache map[string][]Doc) error {
+	for _, v := range c.lookups {
+		value := doc[v.local]
+		key := toPath(v.table, v.foreign, value)
+		docs, ok := cache[key]
+		if !ok && len(value) > 0 {
+			foreign := c.db.Query(v.table).Eq(v.foreign, value)
+			if c.hideInternal {
+				foreign.HideInternal()
+			}
+			// 关联查询同样受当前查询的 context 控制
+			foreign.ctx = c.ctx
+			var err error
+			docs, err = foreign.List()
+			if err != nil {
+				return err
+			}
+			cache[key] = docs
+		}
+		if docs == nil {
+			docs = []Doc{}
+		}
+		bs, err := json.Marshal(docs)
+		if err != nil {
+			return err
+		}
+		doc[v.as] = string(bs)
+	}
+	return nil
+}
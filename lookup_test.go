@@ -0,0 +1,184 @@
+package kv2doc_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dpwgc/kv2doc"
+	"github.com/dpwgc/kv2doc/store"
+	"strings"
+	"testing"
+)
+
+func TestLookup(t *testing.T) {
+	db, _ := newTestDB(t)
+	addDocs(t, db, "customers",
+		kv2doc.Doc{"cid": "c1", "name": "alice"},
+		kv2doc.Doc{"cid": "c2", "name": "bob"},
+		kv2doc.Doc{"cid": "c2", "name": "bob (duplicate)"},
+	)
+	addDocs(t, db, "orders",
+		kv2doc.Doc{"no": "1", "customer": "c1"},
+		kv2doc.Doc{"no": "2", "customer": "c9"},
+		kv2doc.Doc{"no": "3", "customer": "c2"},
+		kv2doc.Doc{"no": "4"},
+		kv2doc.Doc{"no": "5", "customer": "c1"},
+	)
+
+	tests := []struct {
+		name  string
+		query func() *kv2doc.Query
+		// 每个返回的订单号及关联到的客户数量
+		want map[string]int
+		// Count 不受分页影响
+		wantCount int64
+	}{
+		{
+			name:      "left",
+			query:     func() *kv2doc.Query { return db.Query("orders").Lookup("customers", "customer", "cid", "buyer") },
+			want:      map[string]int{"1": 1, "2": 0, "3": 2, "4": 0, "5": 1},
+			wantCount: 5,
+		},
+		{
+			name:      "inner",
+			query:     func() *kv2doc.Query { return db.Query("orders").InnerLookup("customers", "customer", "cid", "buyer") },
+			want:      map[string]int{"1": 1, "3": 2, "5": 1},
+			wantCount: 3,
+		},
+		{
+			// 分页作用于内连接之后的结果
+			name: "inner with limit",
+			query: func() *kv2doc.Query {
+				return db.Query("orders").InnerLookup("customers", "customer", "cid", "buyer").Desc("no").Limit(0, 2)
+			},
+			want:      map[string]int{"5": 1, "3": 2},
+			wantCount: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			docs, err := tt.query().List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string]int)
+			for _, v := range docs {
+				var buyers []kv2doc.Doc
+				if err = json.Unmarshal([]byte(v["buyer"]), &buyers); err != nil {
+					t.Fatalf("order %s: buyer = %q: %v", v["no"], v["buyer"], err)
+				}
+				for _, b := range buyers {
+					if b["cid"] != v["customer"] {
+						t.Errorf("order %s joined customer %v", v["no"], b)
+					}
+				}
+				got[v["no"]] = len(buyers)
+			}
+			if len(got) != len(tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			for k, n := range tt.want {
+				if got[k] != n {
+					t.Errorf("got %v, want %v", got, tt.want)
+					break
+				}
+			}
+			count, err := tt.query().Count()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != tt.wantCount {
+				t.Errorf("Count() = %d, want %d", count, tt.wantCount)
+			}
+		})
+	}
+}
+
+// 统计读取文档次数的存储，reads 为按主键读取的次数，scans 为扫描到的文档数量
+type countingStore struct {
+	store.Store
+	reads map[string]int
+	scans map[string]int
+}
+
+func (c countingStore) GetKV(table, key string) (store.KV, error) {
+	if strings.HasPrefix(key, "p/") {
+		c.reads[table]++
+	}
+	return c.Store.GetKV(table, key)
+}
+
+func (c countingStore) ScanKV(table, prefix string, logic func(key string, value []byte) bool) error {
+	return c.Store.ScanKV(table, prefix, func(key string, value []byte) bool {
+		if strings.HasPrefix(key, "p/") {
+			c.scans[table]++
+		}
+		return logic(key, value)
+	})
+}
+
+// 左连接只为最终返回的文档关联，Count 不做左连接；内连接在扫描时只检查是否存在匹配的文档
+func TestLookupReads(t *testing.T) {
+	db, s := newTestDB(t)
+	addDocs(t, db, "customers",
+		kv2doc.Doc{"cid": "c1", "name": "alice"},
+		kv2doc.Doc{"cid": "c2", "name": "bob"},
+		kv2doc.Doc{"cid": "c2", "name": "bob (duplicate)"},
+		kv2doc.Doc{"cid": "c3", "name": "carol"},
+	)
+	// 客户表足够大，关联时走 cid 字段的索引
+	for i := 0; i < 20; i++ {
+		addDocs(t, db, "customers", kv2doc.Doc{"cid": fmt.Sprint("other", i)})
+	}
+	addDocs(t, db, "orders",
+		kv2doc.Doc{"no": "1", "customer": "c2"},
+		kv2doc.Doc{"no": "2", "customer": "c3"},
+		kv2doc.Doc{"no": "3", "customer": "c9"},
+		kv2doc.Doc{"no": "4", "customer": "c1"},
+	)
+	counting := countingStore{Store: s, reads: make(map[string]int), scans: make(map[string]int)}
+	db = kv2doc.ByStore(counting)
+
+	tests := []struct {
+		name  string
+		run   func() error
+		reads int
+	}{
+		{
+			name: "left with limit",
+			run: func() error {
+				_, err := db.Query("orders").Lookup("customers", "customer", "cid", "buyer").Desc("no").Limit(0, 1).List()
+				return err
+			},
+			// 只为订单 4 关联客户 c1
+			reads: 1,
+		},
+		{
+			name: "left count",
+			run: func() error {
+				_, err := db.Query("orders").Lookup("customers", "customer", "cid", "buyer").Count()
+				return err
+			},
+			reads: 0,
+		},
+		{
+			name: "inner count",
+			run: func() error {
+				_, err := db.Query("orders").InnerLookup("customers", "customer", "cid", "buyer").Count()
+				return err
+			},
+			// c1、c2、c3 各读取一个文档确认存在
+			reads: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counting.reads["customers"] = 0
+			if err := tt.run(); err != nil {
+				t.Fatal(err)
+			}
+			if got := counting.reads["customers"]; got != tt.reads {
+				t.Errorf("read %d customers, want %d", got, tt.reads)
+			}
+		})
+	}
+}
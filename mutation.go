@@ -0,0 +1,197 @@
+package kv2doc
+
+import (
+	"errors"
+	"github.com/dpwgc/kv2doc/store"
+)
+
+// 按条件更新或删除时，每个事务最多写入的文档数量
+const mutationBatch = 500
+
+// Mutation 按条件更新或删除的结果
+type Mutation struct {
+	Matched  int64    // 满足查询条件的文档数量（写入前重新检查后仍然满足条件的数量）
+	Affected int64    // 实际更新或删除的文档数量（dry run 时为将会更新或删除的数量）
+	Changes  []Change // dry run 时返回每个文档将会发生的变化
+}
+
+// Change 文档的变化，删除时 After 为空
+type Change struct {
+	ID     string
+	Before Doc
+	After  Doc
+}
+
+// DryRun 预演模式，Update 和 Delete 只返回将会发生的变化，不写入数据
+func (c *Query) DryRun() *Query {
+	if c.isChild {
+		return c
+	}
+	c.dryRun = true
+	return c
+}
+
+// Update 更新满足查询条件的全部文档，set 中的字段覆盖文档中的同名字段，删除 unset 中的字段，其余字段保持不变
+// 文档分批在多个事务中写入并维护索引，写入前会重新检查文档是否仍然满足查询条件，没有改变任何字段的文档不会写入
+// 查询设置了排序及 Limit 时，只更新排序后对应范围内的文档
+func (c *Query) Update(set Doc, unset ...string) (Mutation, error) {
+	if len(set) <= 0 && len(unset) <= 0 {
+		return Mutation{}, errors.New("parameter error")
+	}
+	// 系统字段不能修改
+	internal := func(k string) bool {
+		return k == primaryKey || k == createdAt || k == updatedAt || k == fields
+	}
+	return c.mutate(func(old Doc) (Doc, bool) {
+		doc := make(Doc, len(old)+len(set))
+		for k, v := range old {
+			doc[k] = v
+		}
+		// 由 edit 重新生成字段列表
+		delete(doc, fields)
+		changed := false
+		for k, v := range set {
+			if internal(k) {
+				continue
+			}
+			if cur, ok := doc[k]; !ok || cur != v {
+				doc[k] = v
+				changed = true
+			}
+		}
+		for _, k := range unset {
+			if internal(k) {
+				continue
+			}
+			if _, ok := doc[k]; ok {
+				delete(doc, k)
+				changed = true
+			}
+		}
+		return doc, changed
+	})
+}
+
+// Delete 删除满足查询条件的全部文档，文档分批在多个事务中删除并维护索引，删除前会重新检查文档是否仍然满足查询条件
+// 查询设置了排序及 Limit 时，只删除排序后对应范围内的文档
+func (c *Query) Delete() (Mutation, error) {
+	return c.mutate(func(old Doc) (Doc, bool) {
+		return nil, true
+	})
+}
+
+// 对满足条件的文档逐个调用 fn，fn 返回修改后的文档（为 nil 时删除文档）及是否需要写入
+func (c *Query) mutate(fn func(old Doc) (Doc, bool)) (mutation Mutation, err error) {
+	if c.isChild {
+		return mutation, nil
+	}
+	if len(c.table) <= 0 || c.db == nil {
+		return mutation, errors.New("parameter error")
+	}
+	cc, cancel := c.withContext()
+	defer cancel()
+	ids, err := cc.ids()
+	if err != nil {
+		return mutation, err
+	}
+	filter, err := getFilter(cc.conditions(), cc.params, cc.parser)
+	if err != nil {
+		return mutation, err
+	}
+	for len(ids) > 0 {
+		if err = cc.ctx.Err(); err != nil {
+			return mutation, err
+		}
+		n := len(ids)
+		if n > mutationBatch {
+			n = mutationBatch
+		}
+		matched, affected, changes, err := cc.mutateBatch(ids[:n], filter, fn)
+		mutation.Matched += matched
+		mutation.Affected += affected
+		mutation.Changes = append(mutation.Changes, changes...)
+		if err != nil {
+			return mutation, err
+		}
+		ids = ids[n:]
+	}
+	return mutation, nil
+}
+
+// 在一个事务中修改一批文档
+func (c *Query) mutateBatch(ids []string, filter func(doc Doc) (bool, error), fn func(old Doc) (Doc, bool)) (matched, affected int64, changes []Change, err error) {
+	db := c.db
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	var allKvs []store.KV
+	for _, id := range ids {
+		kv, err := db.store.GetKV(c.table, toPath(primaryPrefix, primaryKey, id))
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		if !kv.HasKey() {
+			continue
+		}
+		old := Doc{}.FromBytes(kv.Value)
+		// 扫描之后文档可能已经被修改
+		if filter != nil {
+			match, err := filter(old)
+			if err != nil && c.strict {
+				return 0, 0, nil, errors.New("evaluate expression on document " + id + ": " + err.Error())
+			}
+			if !match {
+				continue
+			}
+		}
+		matched++
+		doc, ok := fn(old)
+		if !ok {
+			continue
+		}
+		affected++
+		if c.dryRun {
+			changes = append(changes, Change{
+				ID:     id,
+				Before: old,
+				After:  doc,
+			})
+			continue
+		}
+		var kvs []store.KV
+		if doc == nil {
+			kvs, err = db.delete(c.table, id)
+		} else {
+			kvs, err = db.edit(c.table, id, doc)
+		}
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		allKvs = append(allKvs, kvs...)
+	}
+	if len(allKvs) <= 0 {
+		return matched, affected, changes, nil
+	}
+	if err = db.store.SetKV(c.table, allKvs); err != nil {
+		return 0, 0, nil, err
+	}
+	return matched, affected, changes, nil
+}
+
+// 满足查询条件的文档主键，没有排序规则及 Limit 时只扫描主键
+func (c *Query) ids() (ids []string, err error) {
+	cc := *c
+	cc.selects = []string{}
+	if cc.sort == nil && cc.nearest == nil && !cc.limit.enable {
+		err = scan(cc, func(doc Doc) bool {
+			ids = append(ids, doc[primaryKey])
+			return true
+		})
+		return ids, err
+	}
+	_, docs, err := query(cc, false)
+	for _, v := range docs {
+		ids = append(ids, v[primaryKey])
+	}
+	return ids, err
+}
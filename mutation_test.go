@@ -0,0 +1,216 @@
+package kv2doc_test
+
+import (
+	"fmt"
+	"github.com/dpwgc/kv2doc"
+	"github.com/dpwgc/kv2doc/store"
+	"testing"
+)
+
+// 写入 12 个库存记录：warehouse 为 w0、w1、w2 轮流，qty 为 0 到 11
+func addStock(t *testing.T, db *kv2doc.DB) {
+	t.Helper()
+	bulk := db.Bulk("stock")
+	for i := 0; i < 12; i++ {
+		bulk.Add(kv2doc.Doc{"sku": fmt.Sprint("sku", i), "warehouse": fmt.Sprint("w", i%3), "qty": fmt.Sprint(i)})
+	}
+	if _, err := bulk.Exec(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMutation(t *testing.T) {
+	tests := []struct {
+		name   string
+		dryRun bool
+		// 执行修改，返回修改结果
+		mutate       func(q *kv2doc.Query) (kv2doc.Mutation, error)
+		query        func(db *kv2doc.DB) *kv2doc.Query
+		wantMatched  int64
+		wantAffected int64
+		// 修改后（dry run 时仍为修改前）w1 仓库及 hold 状态的记录数量
+		wantW1   int64
+		wantHold int64
+	}{
+		{
+			name:         "update",
+			query:        func(db *kv2doc.DB) *kv2doc.Query { return db.Query("stock").Eq("warehouse", "w1") },
+			mutate:       func(q *kv2doc.Query) (kv2doc.Mutation, error) { return q.Update(kv2doc.Doc{"status": "hold"}) },
+			wantMatched:  4,
+			wantAffected: 4,
+			wantW1:       4,
+			wantHold:     4,
+		},
+		{
+			name:         "update dry run",
+			dryRun:       true,
+			query:        func(db *kv2doc.DB) *kv2doc.Query { return db.Query("stock").Eq("warehouse", "w1") },
+			mutate:       func(q *kv2doc.Query) (kv2doc.Mutation, error) { return q.Update(kv2doc.Doc{"status": "hold"}) },
+			wantMatched:  4,
+			wantAffected: 4,
+			wantW1:       4,
+		},
+		{
+			// 已经在 w1 的记录不需要写入
+			name:         "update unchanged",
+			query:        func(db *kv2doc.DB) *kv2doc.Query { return db.Query("stock").Lt("qty", "6") },
+			mutate:       func(q *kv2doc.Query) (kv2doc.Mutation, error) { return q.Update(kv2doc.Doc{"warehouse": "w1"}) },
+			wantMatched:  6,
+			wantAffected: 4,
+			wantW1:       8,
+		},
+		{
+			name:         "update with limit",
+			query:        func(db *kv2doc.DB) *kv2doc.Query { return db.Query("stock").Desc("qty").Limit(0, 3) },
+			mutate:       func(q *kv2doc.Query) (kv2doc.Mutation, error) { return q.Update(kv2doc.Doc{"status": "hold"}) },
+			wantMatched:  3,
+			wantAffected: 3,
+			wantW1:       4,
+			wantHold:     3,
+		},
+		{
+			// 只删除字段
+			name:         "unset",
+			query:        func(db *kv2doc.DB) *kv2doc.Query { return db.Query("stock").Lt("qty", "6") },
+			mutate:       func(q *kv2doc.Query) (kv2doc.Mutation, error) { return q.Update(nil, "warehouse", "status") },
+			wantMatched:  6,
+			wantAffected: 6,
+			wantW1:       2,
+		},
+		{
+			name:         "delete",
+			query:        func(db *kv2doc.DB) *kv2doc.Query { return db.Query("stock").Eq("warehouse", "w1") },
+			mutate:       func(q *kv2doc.Query) (kv2doc.Mutation, error) { return q.Delete() },
+			wantMatched:  4,
+			wantAffected: 4,
+		},
+		{
+			name:         "delete dry run",
+			dryRun:       true,
+			query:        func(db *kv2doc.DB) *kv2doc.Query { return db.Query("stock").Eq("warehouse", "w1") },
+			mutate:       func(q *kv2doc.Query) (kv2doc.Mutation, error) { return q.Delete() },
+			wantMatched:  4,
+			wantAffected: 4,
+			wantW1:       4,
+		},
+		{
+			name:   "no match",
+			query:  func(db *kv2doc.DB) *kv2doc.Query { return db.Query("stock").Eq("warehouse", "w9") },
+			mutate: func(q *kv2doc.Query) (kv2doc.Mutation, error) { return q.Delete() },
+			wantW1: 4,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, _ := newTestDB(t)
+			addStock(t, db)
+
+			query := tt.query(db)
+			if tt.dryRun {
+				query.DryRun()
+			}
+			mutation, err := tt.mutate(query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mutation.Matched != tt.wantMatched || mutation.Affected != tt.wantAffected {
+				t.Errorf("Matched = %d, Affected = %d, want %d and %d", mutation.Matched, mutation.Affected, tt.wantMatched, tt.wantAffected)
+			}
+			if tt.dryRun {
+				if int64(len(mutation.Changes)) != tt.wantAffected {
+					t.Errorf("got %d changes, want %d", len(mutation.Changes), tt.wantAffected)
+				}
+			} else if len(mutation.Changes) > 0 {
+				t.Errorf("got %d changes without dry run", len(mutation.Changes))
+			}
+
+			// 通过索引查询，确认索引与文档一致
+			w1, err := db.Query("stock").Eq("warehouse", "w1").Count()
+			if err != nil {
+				t.Fatal(err)
+			}
+			hold, err := db.Query("stock").Eq("status", "hold").Count()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if w1 != tt.wantW1 || hold != tt.wantHold {
+				t.Errorf("w1 count = %d, hold count = %d, want %d and %d", w1, hold, tt.wantW1, tt.wantHold)
+			}
+			report, err := db.Check("stock")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !report.IsHealthy() {
+				t.Errorf("Check after mutation: %+v", report)
+			}
+		})
+	}
+}
+
+func TestMutationDryRunChanges(t *testing.T) {
+	db, _ := newTestDB(t)
+	addStock(t, db)
+
+	mutation, err := db.Query("stock").Eq("sku", "sku1").DryRun().Update(kv2doc.Doc{"status": "hold"}, "warehouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mutation.Changes) != 1 {
+		t.Fatalf("got %d changes, want 1", len(mutation.Changes))
+	}
+	change := mutation.Changes[0]
+	if change.Before.ID() != change.ID || change.Before["warehouse"] != "w1" || change.Before.HasField("status") {
+		t.Errorf("Before = %v", change.Before)
+	}
+	if change.After["status"] != "hold" || change.After.HasField("warehouse") {
+		t.Errorf("After = %v", change.After)
+	}
+
+	mutation, err = db.Query("stock").Eq("sku", "sku1").DryRun().Delete()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mutation.Changes) != 1 || mutation.Changes[0].After != nil {
+		t.Errorf("Changes = %+v, want one change with nil After", mutation.Changes)
+	}
+	if _, err = db.Query("stock").Update(kv2doc.Doc{}); err == nil {
+		t.Error("Update with nothing to set or unset returned no error")
+	}
+}
+
+// 扫描之后被其他写入修改过的文档：读取指定主键时返回 qty 为 99 的文档
+type changedStore struct {
+	store.Store
+	key string
+}
+
+func (c changedStore) GetKV(table, key string) (store.KV, error) {
+	kv, err := c.Store.GetKV(table, key)
+	if err != nil || key != c.key {
+		return kv, err
+	}
+	doc := kv2doc.Doc{}.FromBytes(kv.Value)
+	doc["qty"] = "99"
+	kv.Value = doc.ToBytes()
+	return kv, nil
+}
+
+// 写入前重新检查不再满足条件的文档，既不写入也不计入 Matched
+func TestMutationRecheck(t *testing.T) {
+	db, s := newTestDB(t)
+	addStock(t, db)
+	docs, err := db.Query("stock").Eq("sku", "sku0").List()
+	if err != nil || len(docs) != 1 {
+		t.Fatalf("List() = %v, %v", docs, err)
+	}
+	changed := kv2doc.ByStore(changedStore{Store: s, key: "p/_id/" + docs[0].ID()})
+
+	// 全表扫描时直接读取文档内容，只有写入前的重新检查会按主键读取
+	mutation, err := changed.Query("stock").Lt("qty", "6").Update(kv2doc.Doc{"status": "hold"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mutation.Matched != 5 || mutation.Affected != 5 {
+		t.Errorf("Matched = %d, Affected = %d, want 5 and 5", mutation.Matched, mutation.Affected)
+	}
+}
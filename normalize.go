@@ -0,0 +1,157 @@
+package kv2doc
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+const normPrefix = "n"
+
+// 索引归一化方式
+const (
+	Lower  = iota // 转小写
+	Fold          // Unicode 大小写折叠
+	Trim          // 去除首尾空白
+	Accent        // 去除重音符号
+	Width         // 全角字符转半角
+)
+
+// 字段没有定义归一化方式时，EqFold 与 PrefixFold 默认按大小写折叠进行比较
+var defaultNormalizers = []int{Fold}
+
+// 带重音符号的拉丁字母与基础字母的对照表
+var accents = map[rune]rune{}
+
+func init() {
+	table := map[rune]string{
+		'a': "àáâãäåāăą", 'A': "ÀÁÂÃÄÅĀĂĄ",
+		'c': "çćĉċč", 'C': "ÇĆĈĊČ",
+		'd': "ďđ", 'D': "ĎĐ",
+		'e': "èéêëēĕėęě", 'E': "ÈÉÊËĒĔĖĘĚ",
+		'g': "ĝğġģ", 'G': "ĜĞĠĢ",
+		'h': "ĥħ", 'H': "ĤĦ",
+		'i': "ìíîïĩīĭįı", 'I': "ÌÍÎÏĨĪĬĮİ",
+		'j': "ĵ", 'J': "Ĵ",
+		'k': "ķ", 'K': "Ķ",
+		'l': "ĺļľŀł", 'L': "ĹĻĽĿŁ",
+		'n': "ñńņňŉ", 'N': "ÑŃŅŇ",
+		'o': "òóôõöøōŏő", 'O': "ÒÓÔÕÖØŌŎŐ",
+		'r': "ŕŗř", 'R': "ŔŖŘ",
+		's': "śŝşš", 'S': "ŚŜŞŠ",
+		't': "ţťŧ", 'T': "ŢŤŦ",
+		'u': "ùúûüũūŭůűų", 'U': "ÙÚÛÜŨŪŬŮŰŲ",
+		'w': "ŵ", 'W': "Ŵ",
+		'y': "ýÿŷ", 'Y': "ÝŸŶ",
+		'z': "źżž", 'Z': "ŹŻŽ",
+	}
+	for base, rs := range table {
+		for _, r := range rs {
+			accents[r] = base
+		}
+	}
+}
+
+// 按顺序使用多种归一化方式处理字符串
+func normalize(s string, normalizers []int) string {
+	for _, v := range normalizers {
+		switch v {
+		case Lower:
+			s = strings.ToLower(s)
+		case Fold:
+			s = strings.Map(fold, s)
+		case Trim:
+			s = strings.TrimSpace(s)
+		case Accent:
+			s = strings.Map(func(r rune) rune {
+				if base, ok := accents[r]; ok {
+					return base
+				}
+				// 去除组合用重音符号
+				if unicode.Is(unicode.Mn, r) {
+					return -1
+				}
+				return r
+			}, s)
+		case Width:
+			s = strings.Map(func(r rune) rune {
+				if r == '　' {
+					return ' '
+				}
+				if r >= '！' && r <= '～' {
+					return r - 0xfee0
+				}
+				return r
+			}, s)
+		}
+	}
+	return s
+}
+
+// 大小写折叠，先转大写再转小写，使 ſ、K（开尔文符号）等特殊字符也能折叠为相同的小写字母
+func fold(r rune) rune {
+	return unicode.ToLower(unicode.ToUpper(r))
+}
+
+// EqFold 归一化后等于（需要先用 Define 为字段设置 Normalizers 才能走索引，否则按大小写折叠进行比较）
+func (c *Query) EqFold(field, value string) *Query {
+	name := c.bind(field)
+	c.add(`(normalize(` + name + `, ` + toField(field) + `) == normalize(` + name + `, ` + c.bind(value) + `))`)
+	c.selectIndex(eqFold, field, value)
+	c.recordOp(field, opEqFold, value)
+	return c
+}
+
+// PrefixFold 归一化后具有相同的前缀（需要先用 Define 为字段设置 Normalizers 才能走索引，否则按大小写折叠进行比较）
+func (c *Query) PrefixFold(field, value string) *Query {
+	name := c.bind(field)
+	c.add(`(hasPrefix(normalize(` + name + `, ` + toField(field) + `), normalize(` + name + `, ` + c.bind(value) + `)) == true)`)
+	c.selectIndex(prefixFold, field, value)
+	c.recordOp(field, opPrefixFold, value)
+	return c
+}
+
+// 表达式中使用的归一化函数，按字段定义的归一化方式处理字段值
+func (c *DB) normalizeFunc(table string) func(params ...any) (any, error) {
+	return func(params ...any) (any, error) {
+		if len(params) != 2 {
+			return nil, errors.New("normalize: wrong number of arguments")
+		}
+		schema, err := c.schema(table)
+		if err != nil {
+			return nil, err
+		}
+		normalizers := schema[fmt.Sprint(params[0])].Normalizers
+		if len(normalizers) <= 0 {
+			normalizers = defaultNormalizers
+		}
+		return normalize(fmt.Sprint(params[1]), normalizers), nil
+	}
+}
+
+// 将归一化查询条件的值转换为索引中的值，字段没有归一化索引时返回 false
+func (c *DB) resolve(table string, index Index) (Index, bool) {
+	if len(index.union) > 0 {
+		for i, v := range index.union {
+			r, ok := c.resolve(table, v)
+			if !ok {
+				return index, false
+			}
+			if i == 0 {
+				index.union = append([]Index{}, index.union...)
+			}
+			index.union[i] = r
+		}
+		return index, true
+	}
+	if index.operator != eqFold && index.operator != prefixFold {
+		return index, true
+	}
+	schema, err := c.schema(table)
+	if err != nil || len(schema[index.field].Normalizers) <= 0 {
+		return index, false
+	}
+	index.value = normalize(index.value, schema[index.field].Normalizers)
+	return index, true
+}
@@ -0,0 +1,177 @@
+package kv2doc
+
+import (
+	"errors"
+	"math"
+	"regexp"
+	"regexp/syntax"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Regex 正则匹配，正则表达式在构建查询时编译，表达式不合法时执行查询会返回错误
+// 以 ^ 开头且带有固定前缀的正则表达式（如 ^abc.*）会走字段索引
+func (c *Query) Regex(field, pattern string) *Query {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		if c.err == nil {
+			c.err = errors.New("invalid regex of field " + field + ": " + err.Error())
+		}
+		c.add(`(false)`)
+	} else {
+		c.add(`(regexMatch(` + toField(field) + `, ` + c.bind(re) + `) == true)`)
+		if prefix := regexPrefix(pattern); len(prefix) > 0 {
+			c.selectIndex(leftLike, field, prefix)
+		}
+	}
+	c.recordOp(field, opRegex, pattern)
+	return c
+}
+
+// Between 数值在指定区间内（包含两端）
+// 字段为创建时间或更新时间（毫秒时间戳）时会走时间索引
+func (c *Query) Between(field, lo, hi string) *Query {
+	if field == createdAt || field == updatedAt {
+		from, fromErr := strconv.ParseInt(strings.TrimSpace(lo), 10, 64)
+		to, toErr := strconv.ParseInt(strings.TrimSpace(hi), 10, 64)
+		if fromErr == nil && toErr == nil {
+			return c.between(field, from, to, true, true)
+		}
+	}
+	c.add(`(float(` + toField(field) + `) >= ` + c.bindNumber(field, lo) + ` && float(` + toField(field) + `) <= ` + c.bindNumber(field, hi) + `)`)
+	c.record(map[string]any{field: map[string]any{opGte: toJSONNumber(lo), opLte: toJSONNumber(hi)}})
+	return c
+}
+
+// TimeBefore 时间早于指定时间（不包含），时间可以是 RFC3339 格式或者时间戳（10 位秒级或 13 位毫秒级）
+// 文档中的字段值同样按上述格式解析，字段为创建时间或更新时间时会走时间索引
+func (c *Query) TimeBefore(field, value string) *Query {
+	ms, ok := c.toMillis(field, value)
+	if ok && (field == createdAt || field == updatedAt) {
+		return c.between(field, 0, ms-1, false, true)
+	}
+	c.add(`(epochMillis(` + toField(field) + `) < ` + c.bind(float64(ms)) + `)`)
+	c.recordOp(field, opBefore, value)
+	return c
+}
+
+// TimeAfter 时间晚于指定时间（不包含），格式同 TimeBefore
+func (c *Query) TimeAfter(field, value string) *Query {
+	ms, ok := c.toMillis(field, value)
+	if ok && (field == createdAt || field == updatedAt) {
+		return c.between(field, ms+1, 0, true, false)
+	}
+	c.add(`(epochMillis(` + toField(field) + `) > ` + c.bind(float64(ms)) + `)`)
+	c.recordOp(field, opAfter, value)
+	return c
+}
+
+// IsEmpty 字段不存在或者为空字符串
+func (c *Query) IsEmpty(field string) *Query {
+	c.add(`((` + toEnvField(field) + ` ?? "") == "")`)
+	c.recordOp(field, opEmpty, true)
+	return c
+}
+
+// IsNumeric 字段值是数字
+func (c *Query) IsNumeric(field string) *Query {
+	c.add(`(isNumeric(` + toEnvField(field) + `) == true)`)
+	c.recordOp(field, opNumeric, true)
+	return c
+}
+
+// 解析查询条件中的时间，不是合法时间时记录错误
+func (c *Query) toMillis(field, value string) (int64, bool) {
+	ms, err := toMillis(value)
+	if err != nil {
+		if c.err == nil {
+			c.err = errors.New("value of field " + field + " is not a time: " + value)
+		}
+		return 0, false
+	}
+	return ms, true
+}
+
+// 将 RFC3339 格式的时间或者时间戳转换为毫秒时间戳，小于 1e11 的时间戳视为秒级
+func toMillis(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if n > -1e11 && n < 1e11 {
+			return n * 1000, nil
+		}
+		return n, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return 0, err
+	}
+	return t.UnixMilli(), nil
+}
+
+// 以 ^ 开头的正则表达式的固定前缀，区分大小写等情况下返回空
+func regexPrefix(pattern string) string {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return ""
+	}
+	re = re.Simplify()
+	if re.Op != syntax.OpConcat || len(re.Sub) < 2 || re.Sub[0].Op != syntax.OpBeginText {
+		return ""
+	}
+	literal := re.Sub[1]
+	if literal.Op != syntax.OpLiteral || literal.Flags&syntax.FoldCase != 0 {
+		return ""
+	}
+	prefix := string(literal.Rune)
+	if !utf8.ValidString(prefix) {
+		return ""
+	}
+	return prefix
+}
+
+// 表达式中使用的正则匹配函数，第二个参数是已编译的正则表达式
+func regexMatch(params ...any) (any, error) {
+	if len(params) != 2 {
+		return nil, errors.New("regexMatch: wrong number of arguments")
+	}
+	re, ok := params[1].(*regexp.Regexp)
+	if !ok {
+		return nil, errors.New("regexMatch: invalid regex")
+	}
+	s, ok := params[0].(string)
+	if !ok {
+		return false, nil
+	}
+	return re.MatchString(s), nil
+}
+
+// 表达式中使用的时间解析函数，返回毫秒时间戳
+func epochMillis(params ...any) (any, error) {
+	if len(params) != 1 {
+		return nil, errors.New("epochMillis: wrong number of arguments")
+	}
+	s, ok := params[0].(string)
+	if !ok {
+		return nil, errors.New("epochMillis: value is not a string")
+	}
+	ms, err := toMillis(s)
+	if err != nil {
+		return nil, errors.New("epochMillis: invalid time " + s)
+	}
+	return float64(ms), nil
+}
+
+// 表达式中使用的数字判断函数
+func isNumeric(params ...any) (any, error) {
+	if len(params) != 1 {
+		return nil, errors.New("isNumeric: wrong number of arguments")
+	}
+	s, ok := params[0].(string)
+	if !ok {
+		return false, nil
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	return err == nil && !math.IsNaN(f) && !math.IsInf(f, 0), nil
+}
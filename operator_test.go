@@ -0,0 +1,75 @@
+package kv2doc_test
+
+import (
+	"github.com/dpwgc/kv2doc"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestOperators(t *testing.T) {
+	db, _ := newTestDB(t)
+	addDocs(t, db, "logs",
+		// 时间字段可以是 RFC3339、秒级或毫秒级时间戳
+		kv2doc.Doc{"code": "E100", "at": "2024-01-01T00:00:00Z", "score": "10", "note": "disk"},
+		kv2doc.Doc{"code": "E200", "at": "1704153600", "score": "2.5", "note": ""},
+		kv2doc.Doc{"code": "W100", "at": "1704240000000", "score": "n/a"},
+		kv2doc.Doc{"code": "e300", "at": "yesterday", "score": "-7", "note": "net"},
+	)
+
+	tests := []struct {
+		name  string
+		query *kv2doc.Query
+		want  []string
+	}{
+		{"regex", db.Query("logs").Regex("code", `^E\d00$`), []string{"E100", "E200"}},
+		{"regex case insensitive", db.Query("logs").Regex("code", `(?i)^e`), []string{"E100", "E200", "e300"}},
+		{"regex anywhere", db.Query("logs").Regex("note", `e`), []string{"e300"}},
+		{"between", db.Query("logs").Between("score", "-7", "2.5"), []string{"E200", "e300"}},
+		// 2024-01-02T00:00:00Z 之前，不包含边界
+		{"time before", db.Query("logs").TimeBefore("at", "2024-01-02T00:00:00Z"), []string{"E100"}},
+		{"time after seconds", db.Query("logs").TimeAfter("at", "1704153600"), []string{"W100"}},
+		{"time after millis", db.Query("logs").TimeAfter("at", "1704067199999"), []string{"E100", "E200", "W100"}},
+		{"is empty", db.Query("logs").IsEmpty("note"), []string{"E200", "W100"}},
+		{"is numeric", db.Query("logs").IsNumeric("score"), []string{"E100", "E200", "e300"}},
+		{"not numeric", db.Query("logs").Not(kv2doc.Expr().IsNumeric("score")), []string{"W100"}},
+		{"json", db.Find("logs", `{"code": {"$regex": "^W"}, "note": {"$empty": true}, "score": {"$numeric": false}}`), []string{"W100"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			docs, err := tt.query.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, v := range docs {
+				got = append(got, v["code"])
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// 带有固定前缀的正则表达式先按前缀扫描字段索引
+	explain := db.Query("logs").Regex("code", `^E\d00$`).Explain()
+	found := false
+	for _, v := range explain.Plans {
+		if v.Access == "index" && v.Indexes[0].String() == "f/code/E" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Plans = %+v, want a prefix scan of f/code/E", explain.Plans)
+	}
+
+	for _, query := range []*kv2doc.Query{
+		db.Query("logs").Regex("code", `(`),
+		db.Query("logs").TimeBefore("at", "not a time"),
+	} {
+		if _, err := query.List(); err == nil {
+			t.Errorf("List() with %s returned no error", query.Explain().Expr)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package kv2doc
+
+import (
+	"container/heap"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sort"
+)
+
+// 没有设置 Limit 时每页返回的文档数量
+const defaultPageSize = 20
+
+// 分页令牌，记录上一页最后一个文档的排序字段值及主键
+type pageToken struct {
+	Values []string
+	ID     string
+}
+
+// After 从分页令牌之后开始返回（配合 Page 使用），令牌为空时从第一页开始
+func (c *Query) After(token string) *Query {
+	if c.isChild {
+		return c
+	}
+	c.after = token
+	return c
+}
+
+// Page 游标分页查询，返回一页文档及下一页的令牌（没有下一页时令牌为空）
+// 文档按 Asc/Desc 设置的排序字段排序，排序字段相同时按主键排序，每页大小由 Limit 指定（忽略偏移量）
+// 与 Limit 偏移分页不同，翻页时不会因为新增或删除文档而出现重复或遗漏
+func (c *Query) Page() (docs []Doc, next string, err error) {
+	if c.isChild {
+		return nil, "", nil
+	}
+	cc := *c
+	size := defaultPageSize
+	if cc.limit.enable && cc.limit.size > 0 {
+		size = cc.limit.size
+	}
+	cc.limit.enable = false
+	cc.nearest = nil
+
+	var last *pageToken
+	if len(cc.after) > 0 {
+		last, err = toPageToken(cc.after, len(cc.orders))
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	if cc.db == nil {
+		return nil, "", errors.New("parameter error")
+	}
+	cc, cancel := cc.withContext()
+	defer cancel()
+	plan, _ := cc.db.plan(cc)
+	if seek, ok := cc.seek(last); ok && plan.Access == accessScan {
+		plan = Plan{
+			Access:  accessRange,
+			Indexes: []Index{seek},
+			Rows:    -1,
+			Cost:    -1,
+		}
+	}
+	// 全表扫描按主键顺序进行，没有排序字段时可以直接从上一页的最后一个主键之后开始扫描，并在取够一页后结束
+	ordered := plan.Access == accessScan && len(cc.orders) <= 0 && !cc.descending
+	if ordered && last != nil {
+		cc.start = last.ID
+	}
+
+	// 保留排在最前面的 size+1 个文档，多出的一个用于判断是否还有下一页
+	h := &pageHeap{
+		query: &cc,
+	}
+	err = scanWith(cc, plan, func(doc Doc) bool {
+		if last != nil && !cc.pageLess(last.Values, last.ID, doc) {
+			return true
+		}
+		if h.Len() <= size {
+			heap.Push(h, doc)
+		} else if cc.less(doc, h.docs[0]) {
+			h.docs[0] = doc
+			heap.Fix(h, 0)
+		}
+		return !ordered || h.Len() <= size
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	docs = h.docs
+	sort.SliceStable(docs, func(i, j int) bool {
+		return cc.less(docs[i], docs[j])
+	})
+	if len(docs) > size {
+		docs = docs[:size]
+		next = cc.pageToken(docs[size-1])
+	}
+	if err = cc.attach(docs); err != nil {
+		return nil, "", err
+	}
+	for i, v := range docs {
+		docs[i] = cc.project(v)
+	}
+	return docs, next, nil
+}
+
+// 从上一页最后一个排序字段值开始扫描字段索引，跳过排在前面的文档
+// 非数字的字段值排在所有数字之后、之间按字符串比较，因此只有升序且上一页停在非数字时，之后的文档都在字段索引的 [值, 结尾) 区间内
+// 区间中混入的数字及较小的值由 pageLess 过滤
+func (c *Query) seek(last *pageToken) (Index, bool) {
+	if last == nil || len(c.orders) != 1 || c.descending {
+		return Index{}, false
+	}
+	value := last.Values[0]
+	if _, ok := toDouble(value); ok || len(value) <= 0 {
+		return Index{}, false
+	}
+	field := c.orders[0]
+	index := Index{
+		field:    field,
+		value:    toPath(fieldPrefix, field, value),
+		operator: keyRange,
+		end:      prefixEnd(toPath(fieldPrefix, field, "")),
+	}
+	// 部分索引不包含所有文档
+	if !c.db.usable(*c, index) {
+		return Index{}, false
+	}
+	return index, true
+}
+
+// 文档 l 是否排在文档 r 之前
+func (c *Query) less(l, r Doc) bool {
+	var values []string
+	for _, v := range c.orders {
+		values = append(values, l[v])
+	}
+	return c.pageLess(values, l[primaryKey], r)
+}
+
+// 排序字段值为 values、主键为 id 的文档是否排在文档 doc 之前
+func (c *Query) pageLess(values []string, id string, doc Doc) bool {
+	for i, v := range c.orders {
+		n := compare(values[i], doc[v])
+		if n == 0 {
+			continue
+		}
+		if c.descending {
+			return n > 0
+		}
+		return n < 0
+	}
+	if c.descending {
+		return doc[primaryKey] < id
+	}
+	return id < doc[primaryKey]
+}
+
+func (c *Query) pageToken(doc Doc) string {
+	token := pageToken{
+		ID: doc[primaryKey],
+	}
+	for _, v := range c.orders {
+		token.Values = append(token.Values, doc[v])
+	}
+	bs, _ := json.Marshal(token)
+	return base64.RawURLEncoding.EncodeToString(bs)
+}
+
+func toPageToken(s string, orders int) (*pageToken, error) {
+	bs, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("invalid page token")
+	}
+	token := &pageToken{}
+	if json.Unmarshal(bs, token) != nil || len(token.Values) != orders {
+		return nil, errors.New("invalid page token")
+	}
+	return token, nil
+}
+
+// 按排序规则的大顶堆，堆顶是当前排在最后的文档
+type pageHeap struct {
+	query *Query
+	docs  []Doc
+}
+
+func (h *pageHeap) Len() int           { return len(h.docs) }
+func (h *pageHeap) Less(i, j int) bool { return h.query.less(h.docs[j], h.docs[i]) }
+func (h *pageHeap) Swap(i, j int)      { h.docs[i], h.docs[j] = h.docs[j], h.docs[i] }
+func (h *pageHeap) Push(x any)         { h.docs = append(h.docs, x.(Doc)) }
+func (h *pageHeap) Pop() any {
+	old := h.docs
+	item := old[len(old)-1]
+	h.docs = old[:len(old)-1]
+	return item
+}
@@ -0,0 +1,193 @@
+package kv2doc_test
+
+import (
+	"fmt"
+	"github.com/dpwgc/kv2doc"
+	"strconv"
+	"testing"
+)
+
+func TestPageContinuity(t *testing.T) {
+	db, _ := newTestDB(t)
+	// 排序字段有重复值（包括写法不同的相等数值），重复值之间按主键排序
+	values := []string{"3", "1", "12", "2", "1", "10", "0", "2", "5", "1", "7", "1.0", "1.00"}
+	for _, v := range values {
+		if _, err := db.Add("scores", kv2doc.Doc{"v": v, "type": "1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		query func() *kv2doc.Query
+		size  int
+		// 是否按 v 排序，以及排序方向
+		ordered    bool
+		descending bool
+	}{
+		{"scan", func() *kv2doc.Query { return db.Query("scores") }, 3, false, false},
+		{"index", func() *kv2doc.Query { return db.Query("scores").Eq("type", "1") }, 4, false, false},
+		{"asc", func() *kv2doc.Query { return db.Query("scores").Asc("v") }, 2, true, false},
+		{"desc", func() *kv2doc.Query { return db.Query("scores").Desc("v") }, 3, true, true},
+		{"single", func() *kv2doc.Query { return db.Query("scores").Asc("v") }, 1, true, false},
+		{"larger than table", func() *kv2doc.Query { return db.Query("scores").Desc("v") }, 100, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var docs []kv2doc.Doc
+			token := ""
+			for pages := 0; ; pages++ {
+				if pages > len(values) {
+					t.Fatal("too many pages")
+				}
+				page, next, err := tt.query().Limit(tt.size).After(token).Page()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(page) > tt.size {
+					t.Fatalf("page has %d documents, want at most %d", len(page), tt.size)
+				}
+				docs = append(docs, page...)
+				if len(next) <= 0 {
+					break
+				}
+				token = next
+			}
+
+			// 每个文档恰好出现一次
+			seen := make(map[string]bool)
+			for _, v := range docs {
+				if seen[v.ID()] {
+					t.Errorf("document %s returned twice", v.ID())
+				}
+				seen[v.ID()] = true
+			}
+			if len(seen) != len(values) {
+				t.Errorf("got %d documents, want %d", len(seen), len(values))
+			}
+			if !tt.ordered {
+				return
+			}
+			for i := 1; i < len(docs); i++ {
+				l, r := docs[i-1], docs[i]
+				if tt.descending {
+					l, r = r, l
+				}
+				lf, _ := strconv.ParseFloat(l["v"], 64)
+				rf, _ := strconv.ParseFloat(r["v"], 64)
+				if lf > rf {
+					t.Errorf("documents %v and %v are out of order", docs[i-1], docs[i])
+				}
+			}
+		})
+	}
+}
+
+func TestPageConcurrentInsert(t *testing.T) {
+	db, _ := newTestDB(t)
+	for i := 0; i < 10; i++ {
+		addDocs(t, db, "scores", kv2doc.Doc{"rank": fmt.Sprint(i)})
+	}
+
+	page, next, err := db.Query("scores").Asc("rank").Limit(4).Page()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 翻页之间插入排在第一页之前的文档，不会导致后续页面重复或遗漏
+	addDocs(t, db, "scores", kv2doc.Doc{"rank": "-1"})
+	seen := make(map[string]bool)
+	for _, v := range page {
+		seen[v["rank"]] = true
+	}
+	for len(next) > 0 {
+		page, next, err = db.Query("scores").Asc("rank").Limit(4).After(next).Page()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range page {
+			if seen[v["rank"]] {
+				t.Errorf("rank %s returned twice", v["rank"])
+			}
+			seen[v["rank"]] = true
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if !seen[strconv.Itoa(i)] {
+			t.Errorf("rank %d is missing", i)
+		}
+	}
+	if seen["-1"] {
+		t.Error("document inserted before the current page was returned")
+	}
+}
+
+func TestPageInvalidToken(t *testing.T) {
+	db, _ := newTestDB(t)
+	addDocs(t, db, "scores", kv2doc.Doc{"rank": "1"})
+
+	// 不是 base64、不是 Json、排序字段数量不一致
+	for _, token := range []string{"not base64!", "bm90IGpzb24", "eyJWYWx1ZXMiOltdLCJJRCI6IjEifQ"} {
+		if _, _, err := db.Query("scores").Asc("rank").Limit(1).After(token).Page(); err == nil {
+			t.Errorf("After(%q).Page() returned no error", token)
+		}
+	}
+}
+
+// 数字排在非数字之前，数字之间按数值比较，非数字之间按字符串比较
+func TestPageMixedTypes(t *testing.T) {
+	db, s := newTestDB(t)
+	for _, v := range []string{"b", "10", "a", "9", "a1", "-1", "B"} {
+		addDocs(t, db, "items", kv2doc.Doc{"v": v})
+	}
+	want := []string{"-1", "9", "10", "B", "a", "a1", "b"}
+
+	for _, descending := range []bool{false, true} {
+		var got []string
+		token := ""
+		for pages := 0; pages <= len(want); pages++ {
+			query := db.Query("items").Asc("v")
+			if descending {
+				query = db.Query("items").Desc("v")
+			}
+			page, next, err := query.Limit(2).After(token).Page()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, v := range page {
+				got = append(got, v["v"])
+			}
+			if token = next; len(token) <= 0 {
+				break
+			}
+		}
+		if descending {
+			for i, j := 0, len(got)-1; i < j; i, j = i+1, j-1 {
+				got[i], got[j] = got[j], got[i]
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("descending = %v: got %v, want %v", descending, got, want)
+		}
+	}
+
+	// 升序且上一页停在非数字时，从字段索引中的该值开始扫描，不读取排在前面的文档
+	page, next, err := db.Query("items").Asc("v").Limit(4).Page()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := page[len(page)-1]["v"]; last != "B" {
+		t.Fatalf("first page ends with %s, want B", last)
+	}
+	counting := countingStore{Store: s, reads: make(map[string]int), scans: make(map[string]int)}
+	page, _, err = kv2doc.ByStore(counting).Query("items").Asc("v").Limit(4).After(next).Page()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 3 || page[0]["v"] != "a" {
+		t.Errorf("got %v, want a, a1 and b", page)
+	}
+	// 按字段索引读取 B、a、a1、b，不扫描全表
+	if reads, scans := counting.reads["items"], counting.scans["items"]; reads != 4 || scans != 0 {
+		t.Errorf("read %d and scanned %d documents, want 4 and 0", reads, scans)
+	}
+}
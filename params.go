@@ -0,0 +1,162 @@
+package kv2doc
+
+import (
+	"errors"
+	"fmt"
+	"github.com/expr-lang/expr/file"
+	"github.com/expr-lang/expr/parser/lexer"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// 绑定参数名的前缀
+const paramPrefix = "_p"
+
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// expr 中的关键字，不能直接作为字段名使用
+var keywords = map[string]bool{
+	"and": true, "or": true, "not": true, "in": true, "matches": true, "contains": true,
+	"startsWith": true, "endsWith": true, "nil": true, "true": true, "false": true, "let": true,
+}
+
+// Where 原生 expr 表达式查询，表达式中的参数名会绑定为 params 中对应的值，值不会拼接进表达式源码
+// 例如 Where(`float(age) >= min && name == who`, map[string]any{"min": 18, "who": "bob"})
+func (c *Query) Where(code string, params map[string]any) *Query {
+	bound, err := rename(code, func(name string) (string, bool) {
+		if v, ok := params[name]; ok {
+			return c.bind(v), true
+		}
+		return "", false
+	})
+	if err != nil {
+		if c.err == nil {
+			c.err = errors.New("parse expression " + code + ": " + err.Error())
+		}
+		bound = code
+	}
+	c.add(`(` + bound + `)`)
+	c.record(map[string]any{opWhere: map[string]any{"expr": code, "params": params}})
+	return c
+}
+
+// 绑定参数，返回表达式中引用该参数的名称
+// 参数名按绑定的顺序编号，同一个查询中不会重复，合并子查询时子查询的参数会重新编号
+func (c *Query) bind(value any) string {
+	return bindParam(&c.params, value)
+}
+
+func bindParam(params *map[string]any, value any) string {
+	if *params == nil {
+		*params = make(map[string]any)
+	}
+	// 参数只会增加，参数名都是按数量编号的，新的编号一定没有被使用过
+	name := paramPrefix + strconv.Itoa(len(*params))
+	(*params)[name] = value
+	return name
+}
+
+// 将子查询的参数重新绑定到 params 中，返回子查询参数名到新参数名的映射
+func rebind(params *map[string]any, sub map[string]any) map[string]string {
+	names := make(map[string]string, len(sub))
+	for _, k := range sortedKeys(sub) {
+		names[k] = bindParam(params, sub[k])
+	}
+	return names
+}
+
+// 绑定数值参数，不是数字时记录错误
+func (c *Query) bindNumber(field, value string) string {
+	f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil && c.err == nil {
+		c.err = errors.New("value of field " + field + " is not a number: " + value)
+	}
+	return c.bind(f)
+}
+
+// 合并子查询的参数及错误，返回参数重新编号后的子查询条件（复制，不修改子查询）
+func (c *Query) merge(sc *Query) []*node {
+	if len(sc.unserializable) > 0 {
+		c.opaque(sc.unserializable)
+	}
+	names := rebind(&c.params, sc.params)
+	if c.err == nil {
+		c.err = sc.err
+	}
+	clauses := make([]*node, len(sc.clauses))
+	for i, v := range sc.clauses {
+		clauses[i] = v.rename(names)
+	}
+	return clauses
+}
+
+// 表达式中引用字段的方式，字段名不是合法的标识符时通过 $env 引用
+func toField(field string) string {
+	if identifier.MatchString(field) && !keywords[field] && !strings.HasPrefix(field, paramPrefix) {
+		return field
+	}
+	return toEnvField(field)
+}
+
+// 通过 $env 引用字段，字段不存在时为 nil，不会因为缺少变量而报错
+func toEnvField(field string) string {
+	return `$env[` + strconv.Quote(field) + `]`
+}
+
+// 替换表达式中的变量名（函数名和成员名不会被替换），fn 返回 false 时保持原样
+func rename(code string, fn func(name string) (string, bool)) (string, error) {
+	source := file.NewSource(code)
+	tokens, err := lexer.Lex(source)
+	if err != nil {
+		return "", err
+	}
+	runes := []rune(code)
+	var sb strings.Builder
+	last := 0
+	for i, t := range tokens {
+		if t.Kind != lexer.Identifier {
+			continue
+		}
+		if i > 0 && tokens[i-1].Is(lexer.Operator, ".", "?.") {
+			continue
+		}
+		if i+1 < len(tokens) && tokens[i+1].Is(lexer.Bracket, "(") {
+			continue
+		}
+		name, ok := fn(t.Value)
+		if !ok {
+			continue
+		}
+		sb.WriteString(string(runes[last:t.From]))
+		sb.WriteString(name)
+		last = t.To
+	}
+	sb.WriteString(string(runes[last:]))
+	return sb.String(), nil
+}
+
+// 将表达式中的参数替换为字面量，用于与部分索引条件等文本进行比较
+func inline(code string, params map[string]any) string {
+	if len(params) <= 0 {
+		return code
+	}
+	s, err := rename(code, func(name string) (string, bool) {
+		v, ok := params[name]
+		if !ok {
+			return "", false
+		}
+		switch value := v.(type) {
+		case string:
+			return strconv.Quote(value), true
+		case float64:
+			return toNumber(value), true
+		default:
+			return fmt.Sprint(value), true
+		}
+	})
+	if err != nil {
+		return code
+	}
+	return s
+}
@@ -0,0 +1,74 @@
+package kv2doc_test
+
+import (
+	"github.com/dpwgc/kv2doc"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestBoundValues(t *testing.T) {
+	db, _ := newTestDB(t)
+	addDocs(t, db, "notes",
+		kv2doc.Doc{"title": `say "hi"`, "age": "20"},
+		kv2doc.Doc{"title": `back\slash`, "age": "30"},
+		kv2doc.Doc{"title": `" || true || "`, "age": "40"},
+		kv2doc.Doc{"title": "plain", "age": "50", "user name": "bob"},
+	)
+
+	tests := []struct {
+		name  string
+		query *kv2doc.Query
+		want  []string
+	}{
+		{"quote", db.Query("notes").Eq("title", `say "hi"`), []string{`say "hi"`}},
+		{"backslash", db.Query("notes").Like("title", `k\s`), []string{`back\slash`}},
+		// 值中的表达式代码不会被执行
+		{"injection", db.Query("notes").Ne("age", "0").Eq("title", `" || true || "`), []string{`" || true || "`}},
+		{"injection in scan", db.Query("notes").RightLike("title", `" || true || "`), []string{`" || true || "`}},
+		{"numeric", db.Query("notes").Gt("age", "25").Lt("age", "45"), []string{`back\slash`, `" || true || "`}},
+		{"field name with space", db.Query("notes").Eq("user name", "bob"), []string{"plain"}},
+		{"where", db.Query("notes").Where(`float(age) >= min && title != who`, map[string]any{"min": 30, "who": "plain"}), []string{`back\slash`, `" || true || "`}},
+		{"where with string param", db.Query("notes").Where(`title == t`, map[string]any{"t": `say "hi"`}), []string{`say "hi"`}},
+		// 没有绑定的变量按字段名处理
+		{"where field", db.Query("notes").Where(`age == "20"`, nil), []string{`say "hi"`}},
+		// 打印结果相同的不同参数值分别绑定
+		{"where similar params", db.Query("notes").Where(`age in a && !(age in b)`, map[string]any{"a": []any{"20", "30"}, "b": []any{"20 30"}}), []string{`say "hi"`, `back\slash`}},
+		// 子查询的参数与当前查询的参数分别编号，合并后不会冲突
+		{"merged sub queries", db.Query("notes").Gt("age", "25").Must(kv2doc.Expr().Lt("age", "45")).Not(kv2doc.Expr().Eq("title", "plain").Eq("age", "30")), []string{`back\slash`, `" || true || "`}},
+		{"should sub queries", db.Query("notes").Should(kv2doc.Expr().Eq("age", "20")).Should(kv2doc.Expr().Eq("age", "50")), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			docs, err := tt.query.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, v := range docs {
+				got = append(got, v["title"])
+			}
+			sort.Strings(got)
+			want := append([]string{}, tt.want...)
+			sort.Strings(want)
+			if len(want) == 0 {
+				want = nil
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+
+	// 无法解析的表达式返回错误
+	if docs, err := db.Query("notes").Where(`title ==`, nil).List(); err == nil {
+		t.Errorf("List() = %v, want error", docs)
+	}
+
+	// 值不会拼接进表达式源码
+	expr := db.Query("notes").Eq("title", `" || true || "`).Explain().Expr
+	if len(expr) <= 0 || strings.Contains(expr, `"`) || strings.Contains(expr, "true") {
+		t.Errorf("Expr = %s, want the value bound as a parameter", expr)
+	}
+}
@@ -1,27 +1,154 @@
 package kv2doc
 
 import (
+	"errors"
 	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/ast"
+	"github.com/expr-lang/expr/builtin"
+	"github.com/expr-lang/expr/parser"
+	"github.com/expr-lang/expr/vm"
+	"strconv"
+	"sync"
 )
 
+// 每个解析器最多缓存的已编译表达式数量，超出后清空重新缓存
+const programCache = 1000
+
+// 内置函数名
+var builtins = map[string]bool{}
+
+func init() {
+	for _, v := range builtin.Builtins {
+		builtins[v.Name] = true
+	}
+}
+
 type Parser struct {
+	functions []expr.Option
+	// 已注册的自定义函数名
+	names    map[string]bool
+	mutex    *sync.Mutex
+	programs map[string]*program
+}
+
+// 已编译的表达式
+type program struct {
+	vm *vm.Program
+	// 表达式中引用的变量，文档中缺少任意一个时不匹配
+	names []string
+	err   error
 }
 
 func NewParser() *Parser {
-	return &Parser{}
+	return (&Parser{
+		names:    make(map[string]bool),
+		mutex:    &sync.Mutex{},
+		programs: make(map[string]*program),
+	}).function("geoDistance", geoDistance).function("geoWithin", geoWithin).
+		function("regexMatch", regexMatch).function("epochMillis", epochMillis).function("isNumeric", isNumeric)
+}
+
+// 注册表达式中可以使用的自定义函数
+func (c *Parser) function(name string, fn func(params ...any) (any, error)) *Parser {
+	c.functions = append(c.functions, expr.Function(name, fn))
+	c.names[name] = true
+	return c
 }
 
 func (c *Parser) Match(code string, doc Doc) (bool, error) {
-	program, err := expr.Compile(code, expr.Env(doc))
+	return c.match(code, toEnv(doc, nil))
+}
+
+// 使用文档及绑定参数作为表达式的变量进行匹配
+func (c *Parser) match(code string, env map[string]any) (bool, error) {
+	return c.compile(code).match(env)
+}
+
+// Eval 计算表达式的值
+func (c *Parser) Eval(code string, doc Doc) (any, error) {
+	return c.compile(code).run(toEnv(doc, nil))
+}
+
+// 编译表达式，相同的表达式只编译一次
+func (c *Parser) compile(code string) *program {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if p, ok := c.programs[code]; ok {
+		return p
+	}
+	p := &program{}
+	tree, err := parser.Parse(code)
+	if err == nil {
+		// 与内置函数同名的字段（如 type、len）通过 $env 引用，否则会被当作内置函数
+		var source string
+		source, err = rename(code, func(name string) (string, bool) {
+			if builtins[name] {
+				return `$env[` + strconv.Quote(name) + `]`, true
+			}
+			return "", false
+		})
+		if err == nil {
+			// 不指定变量类型，每个文档的字段可以不同
+			p.vm, err = expr.Compile(source, c.functions...)
+		}
+	}
 	if err != nil {
-		// fmt.Println(err)
-		return false, err
+		p.err = err
+	} else {
+		v := newReferenceVisitor()
+		ast.Walk(&tree.Node, v)
+		for name := range v.callees {
+			// let 声明的变量同样记录在 callees 中，只检查函数调用
+			if !c.names[name] && !v.declared[name] {
+				p.err = errors.New("unknown function " + name)
+			}
+		}
+		for _, id := range v.identifiers {
+			if id != "$env" && !v.callees[id] {
+				p.names = append(p.names, id)
+			}
+		}
+	}
+	if len(c.programs) >= programCache {
+		c.programs = make(map[string]*program)
+	}
+	c.programs[code] = p
+	return p
+}
+
+func (c *program) run(env map[string]any) (any, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	for _, v := range c.names {
+		if _, ok := env[v]; !ok {
+			return nil, errors.New("unknown name " + v)
+		}
 	}
-	output, err := expr.Run(program, doc)
+	return expr.Run(c.vm, env)
+}
+
+func (c *program) match(env map[string]any) (bool, error) {
+	output, err := c.run(env)
 	if err != nil {
-		// fmt.Println(err)
 		return false, err
 	}
-	// fmt.Println(output)
-	return output.(bool), err
+	match, ok := output.(bool)
+	if !ok {
+		return false, errors.New("expression result is not bool")
+	}
+	return match, nil
+}
+
+// 表达式的变量，绑定参数与文档字段同名时以绑定参数为准
+func toEnv(doc Doc, params map[string]any) map[string]any {
+	env := make(map[string]any, len(doc)+len(params))
+	for k, v := range doc {
+		env[k] = v
+	}
+	for k, v := range params {
+		env[k] = v
+	}
+	return env
 }
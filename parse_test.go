@@ -0,0 +1,67 @@
+package kv2doc_test
+
+import (
+	"fmt"
+	"github.com/dpwgc/kv2doc"
+	"path/filepath"
+	"testing"
+)
+
+// 对比逐个匹配文档时，每个文档编译一次表达式（优化前）与缓存编译结果（优化后）的吞吐量
+// go test -run '^$' -bench . -benchmem
+const benchDocs = 2000
+
+func newBenchDB(b *testing.B) *kv2doc.DB {
+	db, err := kv2doc.NewDB(filepath.Join(b.TempDir(), "bench.db"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	bulk := db.Bulk("bench")
+	for i := 0; i < benchDocs; i++ {
+		bulk.Add(kv2doc.Doc{
+			"name":  fmt.Sprintf("user%d", i),
+			"age":   fmt.Sprintf("%d", i%100),
+			"color": []string{"red", "green", "blue"}[i%3],
+		})
+	}
+	if _, err = bulk.Exec(); err != nil {
+		b.Fatal(err)
+	}
+	return db
+}
+
+// 两个基准测试用同一个表达式、同一种方式逐个匹配全部文档，只有是否复用编译结果不同
+const benchExpr = `(float(age) > 50) && (indexOf(name, "9") >= 0) && (color != "red")`
+
+func benchMatch(b *testing.B, parser func() *kv2doc.Parser) {
+	db := newBenchDB(b)
+	var docs []kv2doc.Doc
+	if err := db.Query("bench").Scroll(func(doc kv2doc.Doc) bool {
+		docs = append(docs, doc)
+		return true
+	}); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, doc := range docs {
+			if _, err := parser().Match(benchExpr, doc); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.ReportMetric(float64(len(docs)*b.N)/b.Elapsed().Seconds(), "docs/s")
+}
+
+// 优化前：每个文档使用新的解析器，每次都重新编译表达式
+func BenchmarkMatchUncached(b *testing.B) {
+	benchMatch(b, kv2doc.NewParser)
+}
+
+// 优化后：同一个解析器缓存编译结果，表达式只编译一次
+func BenchmarkMatchCached(b *testing.B) {
+	parser := kv2doc.NewParser()
+	benchMatch(b, func() *kv2doc.Parser {
+		return parser
+	})
+}
@@ -0,0 +1,159 @@
+package kv2doc
+
+import (
+	"github.com/expr-lang/expr/ast"
+	"github.com/expr-lang/expr/parser"
+	"strings"
+)
+
+// 判断文档是否满足字段的部分索引条件，没有设置条件时所有文档都会建立索引
+func (c *DB) covers(table string, field Field, doc Doc) bool {
+	if len(field.Filter) <= 0 {
+		return true
+	}
+	match, _ := c.parserOf(table).Match(field.Filter, doc)
+	return match
+}
+
+// 判断查询条件是否蕴含字段的部分索引条件，只有蕴含时才能使用该字段的部分索引
+func (c *DB) usable(query Query, index Index) bool {
+	if len(index.union) > 0 {
+		for _, v := range index.union {
+			if !c.usable(query, v) {
+				return false
+			}
+		}
+		return true
+	}
+	schema, err := c.schema(query.table)
+	if err != nil {
+		return false
+	}
+	filter := schema[index.field].Filter
+	if len(filter) <= 0 {
+		return true
+	}
+	// 查询中有与部分索引条件完全相同的表达式
+	for _, v := range query.root().conjuncts() {
+		if trimExpr(inline(v.String(), query.params)) == trimExpr(filter) {
+			return true
+		}
+	}
+	// 部分索引条件由若干个等值条件或前缀条件组成，且查询中都有对应的索引条件
+	tree, err := parser.Parse(filter)
+	if err != nil {
+		return false
+	}
+	return implied(tree.Node, query.candidates())
+}
+
+func implied(node ast.Node, indexes []Index) bool {
+	switch n := node.(type) {
+	case *ast.BinaryNode:
+		if n.Operator == "&&" || n.Operator == "and" {
+			return implied(n.Left, indexes) && implied(n.Right, indexes)
+		}
+		if n.Operator == "==" {
+			field, value, ok := toCondition(n.Left, n.Right)
+			if !ok {
+				return false
+			}
+			for _, v := range indexes {
+				if v.operator == eq && v.field == field && v.value == value {
+					return true
+				}
+			}
+		}
+	case *ast.BuiltinNode:
+		if n.Name == "hasPrefix" && len(n.Arguments) == 2 {
+			field, value, ok := toCondition(n.Arguments[0], n.Arguments[1])
+			if !ok {
+				return false
+			}
+			for _, v := range indexes {
+				if (v.operator == eq || v.operator == leftLike) && v.field == field && strings.HasPrefix(v.value, value) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// 解析 “字段 与 字符串常量” 形式的条件
+func toCondition(l, r ast.Node) (field, value string, ok bool) {
+	if _, isString := l.(*ast.StringNode); isString {
+		l, r = r, l
+	}
+	id, ok := l.(*ast.IdentifierNode)
+	if !ok {
+		return "", "", false
+	}
+	s, ok := r.(*ast.StringNode)
+	if !ok {
+		return "", "", false
+	}
+	return id.Value, s.Value, true
+}
+
+// 去除表达式中字符串常量以外的空白字符，以及最外层的括号
+func trimExpr(s string) string {
+	var sb strings.Builder
+	var quote rune
+	escaped := false
+	for _, r := range s {
+		if quote != 0 {
+			sb.WriteRune(r)
+			if escaped {
+				escaped = false
+			} else if r == '\\' {
+				escaped = true
+			} else if r == quote {
+				quote = 0
+			}
+			continue
+		}
+		if r == '"' || r == '\'' || r == '`' {
+			quote = r
+		}
+		if r != ' ' && r != '\t' && r != '\n' && r != '\r' {
+			sb.WriteRune(r)
+		}
+	}
+	s = sb.String()
+	for strings.HasPrefix(s, "(") && closing(s) == len(s)-1 {
+		s = s[1 : len(s)-1]
+	}
+	return s
+}
+
+// 找到与第一个左括号匹配的右括号位置
+func closing(s string) int {
+	depth := 0
+	var quote rune
+	escaped := false
+	for i, r := range s {
+		if quote != 0 {
+			if escaped {
+				escaped = false
+			} else if r == '\\' {
+				escaped = true
+			} else if r == quote {
+				quote = 0
+			}
+			continue
+		}
+		switch r {
+		case '"', '\'', '`':
+			quote = r
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
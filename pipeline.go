@@ -0,0 +1,483 @@
+package kv2doc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/expr-lang/expr/ast"
+	"github.com/expr-lang/expr/parser"
+	"sort"
+	"strconv"
+)
+
+// 聚合管道阶段类型
+const (
+	StageMatch   = "match"   // 筛选文档，Expr 为 expr 表达式
+	StageSet     = "set"     // 计算字段，Set 为 字段名 -> expr 表达式
+	StageGroup   = "group"   // 分组聚合，By 为分组字段，Aggs 为聚合方式
+	StageSort    = "sort"    // 排序，Sort 为排序字段
+	StageProject = "project" // 只保留 Fields 中的字段（_id 总会保留）
+	StageUnwind  = "unwind"  // 将 Field 字段中的 Json 数组展开为多个文档
+	StageSkip    = "skip"    // 跳过前 N 个文档
+	StageLimit   = "limit"   // 只保留前 N 个文档
+)
+
+// Stage 聚合管道的一个阶段，可以序列化为 Json 保存或传输
+type Stage struct {
+	Op     string
+	Expr   string            `json:",omitempty"`
+	Set    map[string]string `json:",omitempty"`
+	By     []string          `json:",omitempty"`
+	Aggs   []Agg             `json:",omitempty"`
+	Sort   []Order           `json:",omitempty"`
+	Fields []string          `json:",omitempty"`
+	Field  string            `json:",omitempty"`
+	N      int               `json:",omitempty"`
+	// match、set 阶段计算表达式出错时中断管道并返回错误，默认跳过该文档或该字段
+	Strict bool `json:",omitempty"`
+}
+
+// Agg 分组聚合方式
+type Agg struct {
+	Op    string // count、countDistinct、sum、avg、min、max
+	Field string
+	As    string
+}
+
+// Order 排序字段
+type Order struct {
+	Field string
+	Desc  bool
+}
+
+var aggOperators = map[string]int{
+	"count":         aggCount,
+	"countDistinct": aggCountDistinct,
+	"sum":           aggSum,
+	"avg":           aggAvg,
+	"min":           aggMin,
+	"max":           aggMax,
+}
+
+// Aggregate 聚合管道，文档依次流经各个阶段，返回最后一个阶段的输出
+// 开头的 match 阶段会作为查询条件参与表的扫描（其中的等值、in、前缀条件可以走索引），group 和 sort 阶段会等待上游的全部文档
+func (c *DB) Aggregate(table string, stages ...Stage) (docs []Doc, err error) {
+	if len(table) <= 0 {
+		return nil, errors.New("parameter error")
+	}
+	query := c.Query(table)
+	// 严格模式作用于整个查询条件，只合并严格模式相同的 match 阶段
+	for len(stages) > 0 && stages[0].Op == StageMatch && (len(query.clauses) <= 0 || stages[0].Strict == query.strict) {
+		query.add(`(` + stages[0].Expr + `)`)
+		if tree, err := parser.Parse(stages[0].Expr); err == nil {
+			query.selectExpr(tree.Node)
+		}
+		query.strict = stages[0].Strict
+		stages = stages[1:]
+	}
+	var sink processor = &collector{
+		docs: &docs,
+	}
+	// 各个阶段处理文档时出现的错误
+	var abort error
+	// 从后往前组装各个阶段
+	for i := len(stages) - 1; i >= 0; i-- {
+		sink, err = newProcessor(stages[i], query.parser, sink, &abort)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = scan(*query, sink.push)
+	if err != nil {
+		return nil, err
+	}
+	if abort != nil {
+		return nil, abort
+	}
+	sink.flush()
+	if abort != nil {
+		return nil, abort
+	}
+	return docs, nil
+}
+
+// 提取表达式中可以走索引的交集条件：字段 == 字符串、字段 in [字符串...]、hasPrefix(字段, 字符串)
+func (c *Query) selectExpr(node ast.Node) {
+	switch n := node.(type) {
+	case *ast.BinaryNode:
+		switch n.Operator {
+		case "&&", "and":
+			c.selectExpr(n.Left)
+			c.selectExpr(n.Right)
+		case "==":
+			if field, value, ok := toCondition(n.Left, n.Right); ok {
+				c.selectIndex(eq, field, value)
+			}
+		case "in":
+			id, ok := n.Left.(*ast.IdentifierNode)
+			array, isArray := n.Right.(*ast.ArrayNode)
+			if !ok || !isArray {
+				return
+			}
+			var values []string
+			for _, v := range array.Nodes {
+				s, ok := v.(*ast.StringNode)
+				if !ok {
+					return
+				}
+				values = append(values, s.Value)
+			}
+			c.selectIndex(in, id.Value, values...)
+		}
+	case *ast.BuiltinNode:
+		if n.Name == "hasPrefix" && len(n.Arguments) == 2 {
+			if _, isString := n.Arguments[0].(*ast.StringNode); isString {
+				return
+			}
+			if field, value, ok := toCondition(n.Arguments[0], n.Arguments[1]); ok {
+				c.selectIndex(leftLike, field, value)
+			}
+		}
+	}
+}
+
+// 管道阶段处理器，push 返回 false 时表示不再需要更多的文档
+type processor interface {
+	push(doc Doc) bool
+	flush()
+}
+
+func newProcessor(stage Stage, parser *Parser, next processor, abort *error) (processor, error) {
+	switch stage.Op {
+	case StageMatch:
+		filter, err := getFilter([]string{stage.Expr}, nil, parser)
+		if err != nil {
+			return nil, err
+		}
+		return &matchProcessor{
+			filter: filter,
+			strict: stage.Strict,
+			abort:  abort,
+			next:   next,
+		}, nil
+	case StageSet:
+		var names []string
+		for k := range stage.Set {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		return &setProcessor{
+			names:  names,
+			exprs:  stage.Set,
+			parser: parser,
+			strict: stage.Strict,
+			abort:  abort,
+			next:   next,
+		}, nil
+	case StageGroup:
+		var aggs []aggregator
+		for _, v := range stage.Aggs {
+			operator, ok := aggOperators[v.Op]
+			if !ok {
+				return nil, errors.New("unknown aggregation: " + v.Op)
+			}
+			as := v.As
+			if len(as) <= 0 {
+				as = v.Field
+			}
+			aggs = append(aggs, aggregator{
+				operator: operator,
+				field:    v.Field,
+				as:       as,
+			})
+		}
+		return &groupProcessor{
+			fields: stage.By,
+			aggs:   aggs,
+			keys:   make(map[string]Doc),
+			states: make(map[string][]*accumulator),
+			next:   next,
+		}, nil
+	case StageSort:
+		return &sortProcessor{
+			orders: stage.Sort,
+			next:   next,
+		}, nil
+	case StageProject:
+		return &projectProcessor{
+			query: Query{selects: stage.Fields},
+			next:  next,
+		}, nil
+	case StageUnwind:
+		return &unwindProcessor{
+			field: stage.Field,
+			next:  next,
+		}, nil
+	case StageSkip:
+		return &skipProcessor{
+			n:    stage.N,
+			next: next,
+		}, nil
+	case StageLimit:
+		return &limitProcessor{
+			n:    stage.N,
+			next: next,
+		}, nil
+	}
+	return nil, errors.New("unknown stage: " + stage.Op)
+}
+
+// 收集最终结果
+type collector struct {
+	docs *[]Doc
+}
+
+func (c *collector) push(doc Doc) bool {
+	*c.docs = append(*c.docs, doc)
+	return true
+}
+
+func (c *collector) flush() {}
+
+type matchProcessor struct {
+	filter func(doc Doc) (bool, error)
+	strict bool
+	abort  *error
+	next   processor
+}
+
+func (c *matchProcessor) push(doc Doc) bool {
+	if c.filter != nil {
+		match, err := c.filter(doc)
+		if err != nil && c.strict {
+			*c.abort = errors.New("evaluate expression on document " + doc[primaryKey] + ": " + err.Error())
+			return false
+		}
+		if !match {
+			return true
+		}
+	}
+	return c.next.push(doc)
+}
+
+func (c *matchProcessor) flush() {
+	c.next.flush()
+}
+
+type setProcessor struct {
+	names  []string
+	exprs  map[string]string
+	parser *Parser
+	strict bool
+	abort  *error
+	next   processor
+}
+
+func (c *setProcessor) push(doc Doc) bool {
+	out := Doc{}
+	for k, v := range doc {
+		out[k] = v
+	}
+	// 每个表达式都基于上游输入的文档计算
+	for _, name := range c.names {
+		value, err := c.parser.Eval(c.exprs[name], doc)
+		if err != nil {
+			if c.strict {
+				*c.abort = errors.New("evaluate expression " + name + " on document " + doc[primaryKey] + ": " + err.Error())
+				return false
+			}
+			continue
+		}
+		if value == nil {
+			delete(out, name)
+			continue
+		}
+		out[name] = toValue(value)
+	}
+	return c.next.push(out)
+}
+
+func (c *setProcessor) flush() {
+	c.next.flush()
+}
+
+type groupProcessor struct {
+	fields []string
+	aggs   []aggregator
+	keys   map[string]Doc
+	states map[string][]*accumulator
+	next   processor
+}
+
+func (c *groupProcessor) push(doc Doc) bool {
+	row := Doc{}
+	values := make([]string, len(c.fields))
+	for i, v := range c.fields {
+		values[i] = doc[v]
+		row[v] = doc[v]
+	}
+	bs, _ := json.Marshal(values)
+	key := string(bs)
+	if _, ok := c.keys[key]; !ok {
+		c.keys[key] = row
+		c.states[key] = newAccumulators(len(c.aggs))
+	}
+	for i, v := range c.aggs {
+		c.states[key][i].push(v, doc)
+	}
+	return true
+}
+
+func (c *groupProcessor) flush() {
+	// 不分组时，即使没有文档也输出一行
+	if len(c.fields) <= 0 && len(c.keys) <= 0 {
+		c.keys["[]"] = Doc{}
+		c.states["[]"] = newAccumulators(len(c.aggs))
+	}
+	var sorted []string
+	for k := range c.keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+	for _, k := range sorted {
+		row := c.keys[k]
+		for i, v := range c.aggs {
+			if value, ok := c.states[k][i].result(v.operator); ok {
+				row[v.as] = value
+			}
+		}
+		if !c.next.push(row) {
+			break
+		}
+	}
+	c.next.flush()
+}
+
+type sortProcessor struct {
+	orders []Order
+	docs   []Doc
+	next   processor
+}
+
+func (c *sortProcessor) push(doc Doc) bool {
+	c.docs = append(c.docs, doc)
+	return true
+}
+
+func (c *sortProcessor) flush() {
+	Sort(c.docs, func(l, r Doc) bool {
+		for _, v := range c.orders {
+			if l[v.Field] == r[v.Field] {
+				continue
+			}
+			if v.Desc {
+				return less(r[v.Field], l[v.Field])
+			}
+			return less(l[v.Field], r[v.Field])
+		}
+		return false
+	})
+	for _, v := range c.docs {
+		if !c.next.push(v) {
+			break
+		}
+	}
+	c.next.flush()
+}
+
+type projectProcessor struct {
+	query Query
+	next  processor
+}
+
+func (c *projectProcessor) push(doc Doc) bool {
+	return c.next.push(c.query.project(doc))
+}
+
+func (c *projectProcessor) flush() {
+	c.next.flush()
+}
+
+type unwindProcessor struct {
+	field string
+	next  processor
+}
+
+func (c *unwindProcessor) push(doc Doc) bool {
+	var values []any
+	if json.Unmarshal([]byte(doc[c.field]), &values) != nil {
+		// 不是数组的字段值原样输出
+		return c.next.push(doc)
+	}
+	for _, v := range values {
+		out := Doc{}
+		for k, dv := range doc {
+			out[k] = dv
+		}
+		out[c.field] = toValue(v)
+		if !c.next.push(out) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *unwindProcessor) flush() {
+	c.next.flush()
+}
+
+type skipProcessor struct {
+	n       int
+	skipped int
+	next    processor
+}
+
+func (c *skipProcessor) push(doc Doc) bool {
+	if c.skipped < c.n {
+		c.skipped++
+		return true
+	}
+	return c.next.push(doc)
+}
+
+func (c *skipProcessor) flush() {
+	c.next.flush()
+}
+
+type limitProcessor struct {
+	n     int
+	count int
+	next  processor
+}
+
+func (c *limitProcessor) push(doc Doc) bool {
+	if c.count >= c.n {
+		return false
+	}
+	c.count++
+	if !c.next.push(doc) {
+		return false
+	}
+	return c.count < c.n
+}
+
+func (c *limitProcessor) flush() {
+	c.next.flush()
+}
+
+// 将表达式的计算结果转换为字段值
+func toValue(v any) string {
+	switch value := v.(type) {
+	case string:
+		return value
+	case float64:
+		return toNumber(value)
+	case int:
+		return strconv.Itoa(value)
+	case []any, map[string]any:
+		bs, _ := json.Marshal(value)
+		return string(bs)
+	default:
+		return fmt.Sprint(value)
+	}
+}
@@ -0,0 +1,133 @@
+package kv2doc_test
+
+import (
+	"encoding/json"
+	"github.com/dpwgc/kv2doc"
+	"reflect"
+	"testing"
+)
+
+func TestAggregate(t *testing.T) {
+	db, _ := newTestDB(t)
+	addDocs(t, db, "orders",
+		kv2doc.Doc{"user": "alice", "status": "paid", "amount": "1.5", "tags": `["gift","food"]`},
+		kv2doc.Doc{"user": "alice", "status": "paid", "amount": "2", "tags": `["food"]`},
+		kv2doc.Doc{"user": "bob", "status": "paid", "amount": "4", "tags": `[]`},
+		kv2doc.Doc{"user": "bob", "status": "open", "amount": "100", "tags": `["gift"]`},
+		kv2doc.Doc{"user": "carol", "status": "paid", "amount": "0.25", "tags": "none"},
+	)
+
+	tests := []struct {
+		name   string
+		stages []kv2doc.Stage
+		want   []kv2doc.Doc
+	}{
+		{
+			name: "match set group sort limit",
+			stages: []kv2doc.Stage{
+				{Op: kv2doc.StageMatch, Expr: `status == "paid"`},
+				{Op: kv2doc.StageSet, Set: map[string]string{"cents": `float(amount) * 100`}},
+				{Op: kv2doc.StageGroup, By: []string{"user"}, Aggs: []kv2doc.Agg{{Op: "sum", Field: "cents", As: "total"}}},
+				{Op: kv2doc.StageSort, Sort: []kv2doc.Order{{Field: "total", Desc: true}}},
+				{Op: kv2doc.StageLimit, N: 2},
+			},
+			want: []kv2doc.Doc{{"user": "bob", "total": "400"}, {"user": "alice", "total": "350"}},
+		},
+		{
+			// 不是数组的字段值原样输出，空数组不输出
+			name: "unwind",
+			stages: []kv2doc.Stage{
+				{Op: kv2doc.StageUnwind, Field: "tags"},
+				{Op: kv2doc.StageGroup, By: []string{"tags"}, Aggs: []kv2doc.Agg{{Op: "count", As: "n"}}},
+			},
+			want: []kv2doc.Doc{{"tags": "food", "n": "2"}, {"tags": "gift", "n": "2"}, {"tags": "none", "n": "1"}},
+		},
+		{
+			name: "sort skip project",
+			stages: []kv2doc.Stage{
+				{Op: kv2doc.StageSort, Sort: []kv2doc.Order{{Field: "user"}, {Field: "amount", Desc: true}}},
+				{Op: kv2doc.StageSkip, N: 2},
+				{Op: kv2doc.StageLimit, N: 2},
+				{Op: kv2doc.StageProject, Fields: []string{"amount"}},
+			},
+			// 金额按数值比较，100 排在 4 前面
+			want: []kv2doc.Doc{{"amount": "100"}, {"amount": "4"}},
+		},
+		{
+			// match 不在开头时在管道中筛选
+			name: "match after set",
+			stages: []kv2doc.Stage{
+				{Op: kv2doc.StageSet, Set: map[string]string{"big": `float(amount) > 3`}},
+				{Op: kv2doc.StageMatch, Expr: `big == "true"`},
+				{Op: kv2doc.StageGroup, Aggs: []kv2doc.Agg{{Op: "count", As: "n"}, {Op: "max", Field: "amount", As: "max"}}},
+			},
+			want: []kv2doc.Doc{{"n": "2", "max": "100"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 管道经过 Json 序列化后结果不变
+			bs, err := json.Marshal(tt.stages)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var stages []kv2doc.Stage
+			if err = json.Unmarshal(bs, &stages); err != nil {
+				t.Fatal(err)
+			}
+			got, err := db.Aggregate("orders", stages...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, v := range got {
+				delete(v, "_id")
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	for _, stage := range []kv2doc.Stage{{Op: "explode"}, {Op: kv2doc.StageGroup, Aggs: []kv2doc.Agg{{Op: "median"}}}} {
+		if _, err := db.Aggregate("orders", stage); err == nil {
+			t.Errorf("Aggregate(%+v) returned no error", stage)
+		}
+	}
+}
+
+func TestAggregateStrict(t *testing.T) {
+	db, _ := newTestDB(t)
+	addDocs(t, db, "orders",
+		kv2doc.Doc{"user": "alice", "amount": "1.5"},
+		kv2doc.Doc{"user": "bob", "amount": "n/a"},
+	)
+
+	// 默认跳过计算出错的字段
+	got, err := db.Aggregate("orders",
+		kv2doc.Stage{Op: kv2doc.StageSet, Set: map[string]string{"cents": `float(amount) * 100`}},
+		kv2doc.Stage{Op: kv2doc.StageGroup, Aggs: []kv2doc.Agg{{Op: "count", Field: "cents", As: "n"}, {Op: "sum", Field: "cents", As: "total"}}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []kv2doc.Doc{{"n": "2", "total": "150"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	for _, stage := range []kv2doc.Stage{
+		{Op: kv2doc.StageSet, Set: map[string]string{"cents": `float(amount) * 100`}, Strict: true},
+		{Op: kv2doc.StageMatch, Expr: `float(amount) > 1`, Strict: true},
+	} {
+		if _, err = db.Aggregate("orders", kv2doc.Stage{Op: kv2doc.StageSkip}, stage); err == nil {
+			t.Errorf("strict %s stage returned no error", stage.Op)
+		}
+	}
+	// 开头的 match 阶段合并到查询条件中，严格模式同样生效
+	if _, err = db.Aggregate("orders", kv2doc.Stage{Op: kv2doc.StageMatch, Expr: `float(amount) > 1`, Strict: true}); err == nil {
+		t.Error("strict leading match stage returned no error")
+	}
+	got, err = db.Aggregate("orders", kv2doc.Stage{Op: kv2doc.StageMatch, Expr: `user == "alice"`})
+	if err != nil || len(got) != 1 || got[0]["user"] != "alice" {
+		t.Errorf("indexed match stage = %v, %v", got, err)
+	}
+}
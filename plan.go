@@ -0,0 +1,429 @@
+package kv2doc
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/dpwgc/kv2doc/store"
+	"sort"
+	"strings"
+)
+
+const (
+	statsPrefix = "s"
+	// 每个字段最多记录的高频取值数量
+	statsValues = 100
+	// 没有统计信息时，探测索引最多扫描的 key 数量
+	probeLimit = 1000
+)
+
+// 代价模型：扫描一个索引 key、按主键读取并过滤一个文档、全表扫描时读取并过滤一个文档
+const (
+	keyCost   = 1
+	fetchCost = 4
+	readCost  = 3
+)
+
+// 访问方式
+const (
+	accessScan      = "scan"
+	accessIndex     = "index"
+	accessIntersect = "intersect"
+	accessRange     = "range"
+	accessCovering  = "covering"
+)
+
+// Plan 访问路径
+type Plan struct {
+	Access  string  // 访问方式：scan 全表扫描，index 索引扫描（多点查询时合并多次扫描的结果），intersect 多个索引结果取交集，range 时间索引区间扫描，covering 只读取索引不读取文档
+	Indexes []Index // 使用的索引
+	Rows    int64   // 估算需要读取的文档数量，-1 表示未知
+	Cost    int64   // 估算代价，-1 表示未知
+}
+
+// 是否比另一个访问路径的代价更低，代价未知的路径排在最后
+func (c Plan) cheaper(o Plan) bool {
+	if c.Cost < 0 {
+		return false
+	}
+	return o.Cost < 0 || c.Cost < o.Cost
+}
+
+// Stats 字段统计信息，由 Analyze 生成
+type Stats struct {
+	Field    string           // 字段名
+	Count    int64            // 含有该字段的文档数量
+	Distinct int64            // 不同取值的数量
+	Values   map[string]int64 // 高频取值及其文档数量
+}
+
+// 是否记录了该字段的全部取值
+func (c Stats) complete() bool {
+	return int64(len(c.Values)) >= c.Distinct
+}
+
+// 根据统计信息估算索引扫描的文档数量
+func (c Stats) estimate(index Index) (int64, bool) {
+	if index.operator == eq {
+		if n, ok := c.Values[index.value]; ok {
+			return n, true
+		}
+		if c.complete() {
+			return 0, true
+		}
+		// 不在高频取值中，按剩余取值的平均文档数量估算
+		rest := c.Count
+		for _, n := range c.Values {
+			rest -= n
+		}
+		avg := rest / (c.Distinct - int64(len(c.Values)))
+		if avg < 1 {
+			avg = 1
+		}
+		return avg, true
+	}
+	if !c.complete() {
+		return 0, false
+	}
+	var rows int64
+	for v, n := range c.Values {
+		if strings.HasPrefix(v, index.value) {
+			rows += n
+		}
+	}
+	return rows, true
+}
+
+// Analyze 统计指定表每个字段的取值分布，供查询时估算索引代价
+// 数据分布变化较大时需要重新执行
+func (c *DB) Analyze(table string) (stats []Stats, err error) {
+	if len(table) <= 0 {
+		return nil, errors.New("parameter error")
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	counts := make(map[string]map[string]int64)
+	prefix := toPath(fieldPrefix, "")
+	err = c.store.ScanKV(table, prefix, func(key string, value []byte) bool {
+		// 索引 key 格式：f/字段名/字段值/主键
+		rest := key[len(prefix):]
+		i := strings.Index(rest, "/")
+		j := strings.LastIndex(rest, "/")
+		if i < 0 || j <= i {
+			return true
+		}
+		field := rest[:i]
+		if counts[field] == nil {
+			counts[field] = make(map[string]int64)
+		}
+		counts[field][rest[i+1:j]]++
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// 覆盖掉旧的统计信息
+	var kvs []store.KV
+	err = c.store.ScanKV(table, toPath(statsPrefix, ""), func(key string, value []byte) bool {
+		kvs = append(kvs, store.KV{
+			Key: key,
+		})
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	for field, values := range counts {
+		s := Stats{
+			Field:    field,
+			Distinct: int64(len(values)),
+			Values:   make(map[string]int64),
+		}
+		var top []string
+		for v, n := range values {
+			s.Count += n
+			top = append(top, v)
+		}
+		sort.Slice(top, func(i, j int) bool {
+			if values[top[i]] == values[top[j]] {
+				return top[i] < top[j]
+			}
+			return values[top[i]] > values[top[j]]
+		})
+		if len(top) > statsValues {
+			top = top[:statsValues]
+		}
+		for _, v := range top {
+			s.Values[v] = values[v]
+		}
+		bs, err := json.Marshal(s)
+		if err != nil {
+			return nil, err
+		}
+		kvs = append(kvs, store.KV{
+			Key:   toPath(statsPrefix, field),
+			Value: bs,
+		})
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Field < stats[j].Field
+	})
+	return stats, c.store.SetKV(table, kvs)
+}
+
+// 读取字段统计信息，没有执行过 Analyze 时返回 nil
+func (c *DB) stats(table, field string) *Stats {
+	kv, err := c.store.GetKV(table, toPath(statsPrefix, field))
+	if err != nil || !kv.HasValue() {
+		return nil
+	}
+	s := &Stats{}
+	if json.Unmarshal(kv.Value, s) != nil {
+		return nil
+	}
+	return s
+}
+
+// 探测索引扫描的 key 数量，最多扫描 probeLimit 个（不超过查询的扫描数量限制），查询取消或超时后停止探测
+// 探测扫描的 key 不计入查询的扫描数量
+func (c *DB) probe(table string, index Index, guard *scanGuard) int64 {
+	limit := guard.probeLimit()
+	var n int64
+	_ = c.scanLeaf(table, index, func(key string, value []byte) bool {
+		n++
+		return n < limit && guard.err() == nil
+	})
+	return n
+}
+
+// 估算索引扫描的文档数量，优先使用统计信息，没有统计信息时探测索引
+func (c *DB) estimate(table string, index Index, guard *scanGuard) int64 {
+	if len(index.union) > 0 {
+		var rows int64
+		for _, v := range index.union {
+			rows += c.estimate(table, v, guard)
+		}
+		return rows
+	}
+	if index.operator == eq || index.operator == leftLike {
+		if s := c.stats(table, index.field); s != nil {
+			if rows, ok := s.estimate(index); ok {
+				return rows
+			}
+		}
+	}
+	return c.probe(table, index, guard)
+}
+
+// 估算表中的文档数量，数据量超过探测上限且没有统计信息，或者查询已取消时返回 -1
+func (c *DB) count(table string, guard *scanGuard) int64 {
+	if s := c.stats(table, primaryKey); s != nil {
+		return s.Count
+	}
+	limit := guard.probeLimit()
+	var n int64
+	_ = c.store.ScanKV(table, toPath(primaryPrefix, primaryKey, ""), func(key string, value []byte) bool {
+		n++
+		return n < limit && guard.err() == nil
+	})
+	if n >= limit || guard.err() != nil {
+		return -1
+	}
+	return n
+}
+
+// 估算每个候选访问路径的代价，选出代价最低的一个
+func (c *DB) plan(query Query) (chosen Plan, plans []Plan) {
+	table := query.table
+	candidates := query.candidates()
+	// 没有可以走索引的条件时直接全表扫描，不需要估算文档数量
+	if len(candidates) <= 0 {
+		chosen = Plan{
+			Access: accessScan,
+			Rows:   -1,
+			Cost:   -1,
+		}
+		return chosen, []Plan{chosen}
+	}
+	// 只用于读取查询的 context 及扫描数量限制，不计数
+	guard := &scanGuard{
+		ctx: query.ctx,
+		max: query.maxScanned,
+	}
+	docs := c.count(table, guard)
+	chosen = Plan{
+		Access: accessScan,
+		Rows:   docs,
+		Cost:   -1,
+	}
+	if docs >= 0 {
+		chosen.Cost = docs * readCost
+	}
+	plans = append(plans, chosen)
+
+	var eqs []Plan
+	seen := make(map[string]bool)
+	for _, v := range candidates {
+		v, ok := c.resolve(table, v)
+		// 部分索引只有在查询条件蕴含索引条件时才能使用
+		// 没有定义为地理位置字段时不存在 geohash 索引，探测结果为空会误判为代价最低
+		if !ok || !c.usable(query, v) || seen[v.String()] || (v.operator == geo && !c.isGeo(table, v.field)) {
+			continue
+		}
+		// 时间索引没有完整建立时，探测结果偏少会误判为代价最低，只能全表扫描
+		if v.operator == timeRange && !c.timeIndexed(table) {
+			continue
+		}
+		seen[v.String()] = true
+		// 查询已取消或超时，不再探测其他索引，扫描时会返回错误
+		if guard.err() != nil {
+			break
+		}
+		rows := c.estimate(table, v, guard)
+		access := accessIndex
+		cost := rows * (keyCost + fetchCost)
+		if v.operator == timeRange {
+			access = accessRange
+		} else if c.covering(query, v) {
+			// 覆盖索引不需要读取文档
+			access = accessCovering
+			cost = rows * keyCost
+		}
+		p := Plan{
+			Access:  access,
+			Indexes: []Index{v},
+			Rows:    rows,
+			Cost:    cost,
+		}
+		plans = append(plans, p)
+		if p.cheaper(chosen) {
+			chosen = p
+		}
+		if v.operator == eq || v.operator == eqFold {
+			eqs = append(eqs, p)
+		}
+	}
+
+	// 存在多个等值条件时，尝试对多个索引的主键集合取交集，减少读取的文档数量
+	if len(eqs) > 1 {
+		sort.SliceStable(eqs, func(i, j int) bool {
+			return eqs[i].Rows < eqs[j].Rows
+		})
+		total := docs
+		if total < 0 {
+			total = probeLimit
+		}
+		if total < 1 {
+			total = 1
+		}
+		p := Plan{
+			Access:  accessIntersect,
+			Indexes: []Index{eqs[0].Indexes[0]},
+			Rows:    eqs[0].Rows,
+		}
+		keys := eqs[0].Rows
+		for _, v := range eqs[1:] {
+			// 假设各字段取值相互独立，估算取交集后剩余的文档数量
+			after := p.Rows * v.Rows / total
+			if v.Rows*keyCost < (p.Rows-after)*fetchCost {
+				p.Indexes = append(p.Indexes, v.Indexes[0])
+				p.Rows = after
+				keys += v.Rows
+			}
+		}
+		if len(p.Indexes) > 1 {
+			p.Cost = keys*keyCost + p.Rows*fetchCost
+			plans = append(plans, p)
+			if p.cheaper(chosen) {
+				chosen = p
+			}
+		}
+	}
+	return chosen, plans
+}
+
+// 扫描单个索引，区间索引按区间扫描，其他索引按前缀扫描
+func (c *DB) scanLeaf(table string, index Index, logic func(key string, value []byte) bool) error {
+	if index.ranged() {
+		return c.rangeKV(table, index.value, index.end, logic)
+	}
+	return c.store.ScanKV(table, index.prefix(), logic)
+}
+
+// 按索引扫描主键，多点查询时逐个扫描并去重
+func (c *DB) scanIndex(table string, index Index, fn func(id string) bool) error {
+	leaves := index.leaves()
+	if len(leaves) == 1 {
+		return c.scanLeaf(table, leaves[0], func(key string, value []byte) bool {
+			return fn(toID(value))
+		})
+	}
+	seen := make(map[string]bool)
+	stop := false
+	for _, leaf := range leaves {
+		err := c.scanLeaf(table, leaf, func(key string, value []byte) bool {
+			id := toID(value)
+			if seen[id] {
+				return true
+			}
+			seen[id] = true
+			stop = !fn(id)
+			return !stop
+		})
+		if err != nil || stop {
+			return err
+		}
+	}
+	return nil
+}
+
+// 对多个索引扫描出的主键取交集，结果保持第一个索引的扫描顺序
+// keys 为扫描的索引 key 数量，每个 key 都计入查询的扫描数量，查询取消、超时或者超出扫描数量限制时返回错误
+func (c *DB) intersect(table string, indexes []Index, guard *scanGuard) (ids []string, keys int64, err error) {
+	var abort error
+	err = c.scanIndex(table, indexes[0], func(id string) bool {
+		keys++
+		if abort = guard.check(); abort != nil {
+			return false
+		}
+		ids = append(ids, id)
+		return true
+	})
+	if err == nil {
+		err = abort
+	}
+	if err != nil {
+		return nil, keys, err
+	}
+	for _, index := range indexes[1:] {
+		if len(ids) <= 0 {
+			break
+		}
+		found := make(map[string]bool)
+		err = c.scanIndex(table, index, func(id string) bool {
+			keys++
+			if abort = guard.check(); abort != nil {
+				return false
+			}
+			found[id] = true
+			return true
+		})
+		if err == nil {
+			err = abort
+		}
+		if err != nil {
+			return nil, keys, err
+		}
+		var rest []string
+		for _, id := range ids {
+			if found[id] {
+				rest = append(rest, id)
+			}
+		}
+		ids = rest
+	}
+	return ids, keys, nil
+}
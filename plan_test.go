@@ -0,0 +1,167 @@
+package kv2doc_test
+
+import (
+	"fmt"
+	"github.com/dpwgc/kv2doc"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// 写入 120 个订单：status 为 open 的只有 6 个，user 有 12 种取值，a、b 各占一半且相互独立
+func addOrders(t *testing.T, db *kv2doc.DB) []kv2doc.Doc {
+	t.Helper()
+	var docs []kv2doc.Doc
+	for i := 0; i < 120; i++ {
+		status := "done"
+		if i%20 == 0 {
+			status = "open"
+		}
+		docs = append(docs, kv2doc.Doc{
+			"status": status,
+			"user":   fmt.Sprintf("u%d", i%12),
+			"a":      fmt.Sprint(i % 2),
+			"b":      fmt.Sprint(i / 2 % 2),
+			"n":      fmt.Sprint(i),
+		})
+	}
+	addDocs(t, db, "orders", docs...)
+	return docs
+}
+
+func TestPlanChoice(t *testing.T) {
+	db, _ := newTestDB(t)
+	docs := addOrders(t, db)
+
+	tests := []struct {
+		name        string
+		query       func() *kv2doc.Query
+		match       func(doc kv2doc.Doc) bool
+		wantAccess  string
+		wantIndexes []string
+	}{
+		{
+			name:  "no index condition",
+			query: func() *kv2doc.Query { return db.Query("orders").Gt("n", "100") },
+			match: func(doc kv2doc.Doc) bool {
+				n, _ := strconv.Atoi(doc["n"])
+				return n > 100
+			},
+			wantAccess: "scan",
+		},
+		{
+			// user 只有 10 个文档，status 为 done 的有 114 个
+			name:        "more selective index",
+			query:       func() *kv2doc.Query { return db.Query("orders").Eq("status", "done").Eq("user", "u3") },
+			match:       func(doc kv2doc.Doc) bool { return doc["status"] == "done" && doc["user"] == "u3" },
+			wantAccess:  "index",
+			wantIndexes: []string{"f/user/u3/"},
+		},
+		{
+			// 两个条件各命中一半文档，取交集后只剩四分之一
+			name:        "intersect",
+			query:       func() *kv2doc.Query { return db.Query("orders").Eq("a", "1").Eq("b", "0") },
+			match:       func(doc kv2doc.Doc) bool { return doc["a"] == "1" && doc["b"] == "0" },
+			wantAccess:  "intersect",
+			wantIndexes: []string{"f/a/1/", "f/b/0/"},
+		},
+		{
+			// In 的每个取值分别走等值索引，重复的取值只扫描一次
+			name:        "in",
+			query:       func() *kv2doc.Query { return db.Query("orders").In("user", "u1", "u5", "u1") },
+			match:       func(doc kv2doc.Doc) bool { return doc["user"] == "u1" || doc["user"] == "u5" },
+			wantAccess:  "index",
+			wantIndexes: []string{"f/user/u1/ | f/user/u5/"},
+		},
+		{
+			// 两个分支命中的文档有重叠，合并时去重
+			name: "should",
+			query: func() *kv2doc.Query {
+				return db.Query("orders").Should(kv2doc.Expr().Eq("status", "open").Eq("user", "u4"))
+			},
+			match:       func(doc kv2doc.Doc) bool { return doc["status"] == "open" || doc["user"] == "u4" },
+			wantAccess:  "index",
+			wantIndexes: []string{"f/status/open/ | f/user/u4/"},
+		},
+		{
+			// 有一个分支不能走索引时只能全表扫描
+			name: "should with unindexed branch",
+			query: func() *kv2doc.Query {
+				return db.Query("orders").Should(kv2doc.Expr().Eq("status", "open").Gt("n", "110"))
+			},
+			match: func(doc kv2doc.Doc) bool {
+				n, _ := strconv.Atoi(doc["n"])
+				return doc["status"] == "open" || n > 110
+			},
+			wantAccess: "scan",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			explain := tt.query().Explain()
+			var indexes []string
+			for _, v := range explain.Plan.Indexes {
+				indexes = append(indexes, v.String())
+			}
+			if explain.Plan.Access != tt.wantAccess || !reflect.DeepEqual(indexes, tt.wantIndexes) {
+				t.Errorf("Plan = %s %v, want %s %v", explain.Plan.Access, indexes, tt.wantAccess, tt.wantIndexes)
+			}
+			var want int64
+			for _, v := range docs {
+				if tt.match(v) {
+					want++
+				}
+			}
+			got, err := tt.query().Count()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("Count() = %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	db, _ := newTestDB(t)
+	addOrders(t, db)
+
+	stats, err := db.Analyze("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status *kv2doc.Stats
+	for i, v := range stats {
+		if v.Field == "status" {
+			status = &stats[i]
+		}
+	}
+	if status == nil {
+		t.Fatalf("no stats for status in %v", stats)
+	}
+	if status.Count != 120 || status.Distinct != 2 || status.Values["open"] != 6 || status.Values["done"] != 114 {
+		t.Errorf("status stats = %+v", *status)
+	}
+
+	// 统计信息表明 open 只有 6 个文档，估算的行数与实际一致
+	explain := db.Query("orders").Eq("status", "open").Explain()
+	if explain.Plan.Access != "index" || explain.Plan.Rows != 6 {
+		t.Errorf("Plan = %+v, want an index scan of 6 rows", explain.Plan)
+	}
+	// 表中文档数量取自统计信息，全表扫描作为候选方案参与比较
+	var scanRows int64
+	for _, v := range explain.Plans {
+		if v.Access == "scan" {
+			scanRows = v.Rows
+		}
+	}
+	if scanRows != 120 {
+		t.Errorf("scan candidate rows = %d, want 120 in %+v", scanRows, explain.Plans)
+	}
+	// 没有可以走索引的条件时不估算代价
+	explain = db.Query("orders").Explain()
+	if explain.Plan.Access != "scan" || explain.Plan.Rows != -1 {
+		t.Errorf("Plan = %+v, want a scan without estimation", explain.Plan)
+	}
+}
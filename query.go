@@ -1,35 +1,135 @@
 package kv2doc
 
 import (
+	"context"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
 	eq = iota
 	in
 	leftLike
+	should
+	geo
+	vector
+	eqFold
+	prefixFold
+	timeRange
+	keyRange
 )
 
 type Query struct {
-	db          *DB
-	table       string
-	expressions []string
-	index       Index
-	limit       limit
-	parser      *Parser
-	sort        func(l, r Doc) bool
-	isChild     bool
+	db      *DB
+	table   string
+	clauses []*node
+	limit   limit
+	parser  *Parser
+	sort    func(l, r Doc) bool
+	nearest *nearest
+	// 需要返回的字段，为 nil 时返回全部字段
+	selects []string
+	// 不需要返回的字段
+	excludes []string
+	// 是否隐藏内部系统字段
+	hideInternal bool
+	// 关联查询
+	lookups []lookup
+	// 表达式中引用的绑定参数
+	params map[string]any
+	// 构建查询时出现的错误，执行查询时返回
+	err error
+	// 严格模式，计算某个文档出错时中断查询并返回错误
+	strict bool
+	// 排序用到的字段及排序方向
+	orders     []string
+	descending bool
+	// 分页令牌，以及全表扫描时的起始主键
+	after   string
+	start   string
+	isChild bool
+	// 执行统计，ExplainAnalyze 时不为空
+	stats *Analysis
+	// 执行查询时使用的 context、超时时间及最多扫描的 key 数量
+	ctx        context.Context
+	timeout    time.Duration
+	maxScanned int
+	// 预演模式，Update 和 Delete 不写入数据
+	dryRun bool
+	// 第一个无法序列化为 Json 的条件
+	unserializable string
+}
+
+// Index 索引扫描条件
+type Index struct {
+	field    string
+	value    string
+	operator uint8
+	// 区间扫描的结束 key（不包含），此时 value 为起始 key
+	end string
+	// 多点查询（In 或者 Should 的各个分支），逐个扫描后合并去重
+	union []Index
+}
+
+// 索引扫描的 key 前缀，等于查询精确匹配字段值，前缀查询匹配字段值的前缀
+func (c Index) prefix() string {
+	switch c.operator {
+	case eq:
+		return toPath(fieldPrefix, c.field, c.value, "")
+	case geo:
+		return toPath(geoPrefix, c.field, c.value)
+	case vector:
+		return toPath(vectorPrefix, c.field, c.value, "")
+	case eqFold:
+		return toPath(normPrefix, c.field, c.value, "")
+	case prefixFold:
+		return toPath(normPrefix, c.field, c.value)
+	case timeRange, keyRange:
+		return c.value
+	default:
+		return toPath(fieldPrefix, c.field, c.value)
+	}
 }
 
-type Index struct {
-	field string
-	value string
+// 是否按区间扫描（包含 value，不包含 end）
+func (c Index) ranged() bool {
+	return c.operator == timeRange || c.operator == keyRange
+}
+
+// 需要逐个扫描的所有索引
+func (c Index) leaves() []Index {
+	if len(c.field) <= 0 && len(c.union) <= 0 {
+		return nil
+	}
+	if len(c.union) <= 0 {
+		return []Index{c}
+	}
+	var ls []Index
+	for _, v := range c.union {
+		ls = append(ls, v.leaves()...)
+	}
+	return ls
+}
+
+func (c Index) String() string {
+	var ss []string
+	for _, v := range c.leaves() {
+		if v.ranged() {
+			ss = append(ss, v.value+" ~ "+v.end)
+		} else {
+			ss = append(ss, v.prefix())
+		}
+	}
+	return strings.Join(ss, " | ")
 }
 
 type Explain struct {
-	Expr  string
-	Index Index
+	Expr   string
+	Params map[string]any // 表达式中引用的绑定参数
+	Index  Index          // 选中的索引（全表扫描时为空）
+	Plan   Plan           // 选中的访问路径
+	Plans  []Plan         // 所有候选访问路径及其估算代价
 }
 
 type limit struct {
@@ -46,38 +146,44 @@ func Expr() *Query {
 
 // Eq 等于
 func (c *Query) Eq(field, value string) *Query {
-	c.expressions = append(c.expressions, `(`+field+` == "`+value+`")`)
+	c.add(`(` + toField(field) + ` == ` + c.bind(value) + `)`)
 	c.selectIndex(eq, field, value)
+	c.record(map[string]any{field: value})
 	return c
 }
 
 // Ne 不等于
 func (c *Query) Ne(field, value string) *Query {
-	c.expressions = append(c.expressions, `(`+field+` != "`+value+`")`)
+	c.add(`(` + toField(field) + ` != ` + c.bind(value) + `)`)
+	c.recordOp(field, opNe, value)
 	return c
 }
 
 // Gt 大于
 func (c *Query) Gt(field, value string) *Query {
-	c.expressions = append(c.expressions, `(float(`+field+`) > `+value+`)`)
+	c.add(`(float(` + toField(field) + `) > ` + c.bindNumber(field, value) + `)`)
+	c.recordOp(field, opGt, toJSONNumber(value))
 	return c
 }
 
 // Gte 大于或等于
 func (c *Query) Gte(field, value string) *Query {
-	c.expressions = append(c.expressions, `(float(`+field+`) >= `+value+`)`)
+	c.add(`(float(` + toField(field) + `) >= ` + c.bindNumber(field, value) + `)`)
+	c.recordOp(field, opGte, toJSONNumber(value))
 	return c
 }
 
 // Lt 小于
 func (c *Query) Lt(field, value string) *Query {
-	c.expressions = append(c.expressions, `(float(`+field+`) < `+value+`)`)
+	c.add(`(float(` + toField(field) + `) < ` + c.bindNumber(field, value) + `)`)
+	c.recordOp(field, opLt, toJSONNumber(value))
 	return c
 }
 
 // Lte 小于或等于
 func (c *Query) Lte(field, value string) *Query {
-	c.expressions = append(c.expressions, `(float(`+field+`) <= `+value+`)`)
+	c.add(`(float(` + toField(field) + `) <= ` + c.bindNumber(field, value) + `)`)
+	c.recordOp(field, opLte, toJSONNumber(value))
 	return c
 }
 
@@ -85,10 +191,11 @@ func (c *Query) Lte(field, value string) *Query {
 func (c *Query) In(field string, values ...string) *Query {
 	var els []string
 	for _, v := range values {
-		els = append(els, `(`+field+` == "`+v+`")`)
+		els = append(els, `(`+toField(field)+` == `+c.bind(v)+`)`)
 	}
-	c.expressions = append(c.expressions, `(`+strings.Join(els, ` || `)+`)`)
+	c.add(`(` + strings.Join(els, ` || `) + `)`)
 	c.selectIndex(in, field, values...)
+	c.recordOp(field, opIn, values)
 	return c
 }
 
@@ -96,36 +203,41 @@ func (c *Query) In(field string, values ...string) *Query {
 func (c *Query) NotIn(field string, values ...string) *Query {
 	var els []string
 	for _, v := range values {
-		els = append(els, `(`+field+` != "`+v+`")`)
+		els = append(els, `(`+toField(field)+` != `+c.bind(v)+`)`)
 	}
-	c.expressions = append(c.expressions, `(`+strings.Join(els, ` && `)+`)`)
+	c.add(`(` + strings.Join(els, ` && `) + `)`)
+	c.recordOp(field, opNin, values)
 	return c
 }
 
 // Like 模糊匹配
 func (c *Query) Like(field, value string) *Query {
-	c.expressions = append(c.expressions, `(indexOf(`+field+`, "`+value+`") >= 0)`)
+	c.add(`(indexOf(` + toField(field) + `, ` + c.bind(value) + `) >= 0)`)
+	c.recordOp(field, opLike, value)
 	return c
 }
 
 // LeftLike 模糊匹配-具有相同的前缀
 // 此方法会走字段索引
 func (c *Query) LeftLike(field, value string) *Query {
-	c.expressions = append(c.expressions, `(hasPrefix(`+field+`, "`+value+`") == true)`)
+	c.add(`(hasPrefix(` + toField(field) + `, ` + c.bind(value) + `) == true)`)
 	c.selectIndex(leftLike, field, value)
+	c.recordOp(field, opPrefix, value)
 	return c
 }
 
 // RightLike 模糊匹配-具有相同的后缀
 func (c *Query) RightLike(field, value string) *Query {
-	c.expressions = append(c.expressions, `(hasSuffix(`+field+`, "`+value+`") == true)`)
+	c.add(`(hasSuffix(` + toField(field) + `, ` + c.bind(value) + `) == true)`)
+	c.recordOp(field, opSuffix, value)
 	return c
 }
 
 // Exist 存在该字段
 func (c *Query) Exist(field string) *Query {
 	if field != primaryKey && field != createdAt && field != updatedAt {
-		c.expressions = append(c.expressions, `(indexOf(_fields, "/`+field+`") >= 0)`)
+		c.add(`(indexOf(_fields, ` + c.bind("/"+field) + `) >= 0)`)
+		c.recordOp(field, opExists, true)
 	}
 	return c
 }
@@ -133,22 +245,30 @@ func (c *Query) Exist(field string) *Query {
 // NotExist 不存在该字段
 func (c *Query) NotExist(field string) *Query {
 	if field != primaryKey && field != createdAt && field != updatedAt {
-		c.expressions = append(c.expressions, `(indexOf(_fields, "/`+field+`") < 0)`)
+		c.add(`(indexOf(_fields, ` + c.bind("/"+field) + `) < 0)`)
 	} else {
-		c.expressions = append(c.expressions, `(false)`)
+		c.add(`(false)`)
 	}
+	c.recordOp(field, opExists, false)
 	return c
 }
 
 // Must 交集拼接
 func (c *Query) Must(sc *Query) *Query {
-	c.expressions = append(c.expressions, `(`+strings.Join(sc.expressions, " && ")+`)`)
+	c.clauses = append(c.clauses, &node{
+		operator: nodeAnd,
+		children: c.merge(sc),
+	})
 	return c
 }
 
 // Should 并集拼接
+// 如果每个分支都可以走索引，会逐个分支扫描索引后合并结果
 func (c *Query) Should(sc *Query) *Query {
-	c.expressions = append(c.expressions, `(`+strings.Join(sc.expressions, " || ")+`)`)
+	c.clauses = append(c.clauses, &node{
+		operator: nodeOr,
+		children: c.merge(sc),
+	})
 	return c
 }
 
@@ -169,42 +289,33 @@ func (c *Query) orderBy(rule int, fields ...string) *Query {
 	if c.isChild {
 		return c
 	}
+	c.orders = fields
+	c.descending = rule == desc
 	c.sort = func(l, r Doc) bool {
 		for _, v := range fields {
-			if l[v] == r[v] {
+			n := compare(l[v], r[v])
+			if n == 0 {
 				continue
 			}
-			ld, lb := toDouble(l[v])
-			rd, rb := toDouble(r[v])
-			if lb && rb {
-				if rule == asc {
-					if ld < rd {
-						return true
-					}
-				}
-				if rule == desc {
-					if ld > rd {
-						return true
-					}
-				}
-			} else {
-				if rule == asc {
-					if l[v] < r[v] {
-						return true
-					}
-				}
-				if rule == desc {
-					if l[v] > r[v] {
-						return true
-					}
-				}
+			if rule == desc {
+				return n > 0
 			}
+			return n < 0
 		}
 		return false
 	}
 	return c
 }
 
+// Strict 严格模式，某个文档计算查询条件出错时（例如缺少 float() 中使用的字段）中断查询并返回错误，默认跳过该文档
+func (c *Query) Strict() *Query {
+	if c.isChild {
+		return c
+	}
+	c.strict = true
+	return c
+}
+
 // Limit 分页方法，逻辑和 MySQL 的 Limit 相同，limit 10 或 limit 0,10
 func (c *Query) Limit(values ...int) *Query {
 	if c.isChild {
@@ -264,6 +375,10 @@ func (c *Query) Count() (count int64, err error) {
 	}
 	cc := *c
 	cc.limit.enable = false
+	// 计数不需要排序，也不需要任何字段，可以只扫描索引
+	cc.sort = nil
+	cc.orders = nil
+	cc.selects = []string{}
 	count, _, err = query(cc, true)
 	return count, err
 }
@@ -274,71 +389,77 @@ func (c *Query) Scroll(fn func(doc Doc) bool) error {
 		return nil
 	}
 	cc := *c
-	return scan(cc, fn)
+	if fn == nil {
+		return scan(cc, nil)
+	}
+	cache := make(map[string][]Doc)
+	var joinErr error
+	err := scan(cc, func(doc Doc) bool {
+		if joinErr = cc.join(doc, cache); joinErr != nil {
+			return false
+		}
+		return fn(cc.project(doc))
+	})
+	if err != nil {
+		return err
+	}
+	return joinErr
 }
 
 // Explain 执行计划
 func (c *Query) Explain() Explain {
-	return Explain{
-		Expr:  strings.Join(c.expressions, " && "),
-		Index: c.index,
+	explain := Explain{
+		Expr:   strings.Join(c.conditions(), " && "),
+		Params: c.params,
+	}
+	if c.isChild || c.db == nil {
+		return explain
 	}
+	explain.Plan, explain.Plans = c.db.plan(*c)
+	if len(explain.Plan.Indexes) > 0 {
+		explain.Index = explain.Plan.Indexes[0]
+	}
+	return explain
 }
 
+// 记录可以走索引的查询条件，具体走哪个索引由执行时的代价估算决定
 func (c *Query) selectIndex(operator uint8, field string, values ...string) {
-	if c.isChild || len(field) <= 0 || len(values) <= 0 {
+	if len(field) <= 0 || len(values) <= 0 {
 		return
 	}
 	var vs []string
+	seen := make(map[string]bool)
 	for _, v := range values {
-		if len(v) > 0 {
+		if len(v) > 0 && !seen[v] {
+			seen[v] = true
 			vs = append(vs, v)
 		}
 	}
 	if len(vs) <= 0 {
 		return
 	}
-	// 如果当前没有命中的索引值
-	if len(c.index.field) <= 0 {
-		// 如果是等于或者左like查询，走索引
-		if operator == eq || operator == leftLike {
-			c.index.field = field
-			c.index.value = vs[0]
-		} else if operator == in {
-			// 如果是in查询，并且有共同前缀的话，走索引
-			prefix := getCommonPrefix(vs)
-			if len(prefix) > 0 {
-				c.index.field = field
-				c.index.value = prefix
-			}
+	// 如果是等于或者左like查询，可以走索引
+	if operator == eq || operator == leftLike || operator == eqFold || operator == prefixFold {
+		c.last().indexes = append(c.last().indexes, Index{
+			field:    field,
+			value:    vs[0],
+			operator: operator,
+		})
+	} else if operator == in {
+		// 如果是in查询，对每个值分别走等值索引，再合并结果
+		index := Index{
+			field:    field,
+			operator: in,
 		}
-	}
-}
-
-func getCommonPrefix(ss []string) (prefix string) {
-	if len(ss) == 0 {
-		return ""
-	}
-	for i := 0; i < len(ss[0]); i++ {
-		firstStringChar := string(ss[0][i])
-		match := true
-		for j := 1; j < len(ss); j++ {
-			if (len(ss[j]) - 1) < i {
-				match = false
-				break
-			}
-			if string(ss[j][i]) != firstStringChar {
-				match = false
-				break
-			}
-		}
-		if match {
-			prefix += firstStringChar
-		} else {
-			break
+		for _, v := range vs {
+			index.union = append(index.union, Index{
+				field:    field,
+				value:    v,
+				operator: eq,
+			})
 		}
+		c.last().indexes = append(c.last().indexes, index)
 	}
-	return prefix
 }
 
 func toDouble(s string) (float64, bool) {
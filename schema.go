@@ -0,0 +1,123 @@
+package kv2doc
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/dpwgc/kv2doc/store"
+	"github.com/expr-lang/expr/parser"
+	"sort"
+)
+
+const metaPrefix = "m"
+
+// 字段类型
+const (
+	Text   = iota // 普通文本字段（默认）
+	Geo           // 地理位置字段，字段值格式为 "纬度,经度"，会额外建立 geohash 索引
+	Vector        // 向量字段，字段值格式为 "[0.1,0.2,0.3]"，设置 Lists 后会额外建立 IVF 近似索引
+)
+
+// Field 字段定义
+type Field struct {
+	Name string
+	Type int
+	// 向量维度，维度不一致的向量不参与索引和相似度计算，为 0 时不校验
+	Dim int
+	// 向量近似索引的聚类数量，为 0 时只支持精确查询
+	Lists int
+	// 向量近似查询时扫描的聚类数量，为 0 时默认扫描 Lists/4 个
+	Probes int
+	// 索引归一化方式（Lower、Fold、Trim、Accent、Width），按顺序处理后额外建立归一化索引，文档中保存的仍然是原始值
+	Normalizers []int
+	// 部分索引条件（expr 表达式），设置后只有满足条件的文档才会建立该字段的索引
+	Filter string
+	// 覆盖索引额外保存的字段，查询只用到这些字段时可以直接从索引中读取，不需要读取文档内容
+	Include []string
+}
+
+// Define 定义指定表的字段（表不存在时自动建表），定义完成后会重建该表的索引
+func (c *DB) Define(table string, fields ...Field) error {
+	if len(table) <= 0 || len(fields) <= 0 {
+		return errors.New("parameter error")
+	}
+	err := c.define(table, fields)
+	if err != nil {
+		return err
+	}
+	return c.Reindex(table)
+}
+
+func (c *DB) define(table string, defines []Field) error {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	err := c.store.CreateTable(table)
+	if err != nil {
+		return err
+	}
+	var kvs []store.KV
+	for _, v := range defines {
+		if len(v.Name) <= 0 {
+			return errors.New("parameter error")
+		}
+		if len(v.Filter) > 0 {
+			// 系统字段的索引必须完整
+			if v.Name == primaryKey || v.Name == createdAt || v.Name == updatedAt || v.Name == fields {
+				return errors.New("system field can not have filter")
+			}
+			if _, err := parser.Parse(v.Filter); err != nil {
+				return err
+			}
+		}
+		bs, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		kvs = append(kvs, store.KV{
+			Key:   toPath(metaPrefix, v.Name),
+			Value: bs,
+		})
+	}
+	err = c.store.SetKV(table, kvs)
+	if err != nil {
+		return err
+	}
+	c.schemas.Delete(table)
+	return nil
+}
+
+// Fields 返回指定表的全部字段定义
+func (c *DB) Fields(table string) (fields []Field, err error) {
+	schema, err := c.schema(table)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range schema {
+		fields = append(fields, v)
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].Name < fields[j].Name
+	})
+	return fields, nil
+}
+
+// 读取表的字段定义，读取后缓存在内存中
+func (c *DB) schema(table string) (map[string]Field, error) {
+	if v, ok := c.schemas.Load(table); ok {
+		return v.(map[string]Field), nil
+	}
+	schema := make(map[string]Field)
+	err := c.store.ScanKV(table, toPath(metaPrefix, ""), func(key string, value []byte) bool {
+		field := Field{}
+		if json.Unmarshal(value, &field) == nil && len(field.Name) > 0 {
+			schema[field.Name] = field
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.schemas.Store(table, schema)
+	return schema, nil
+}
@@ -0,0 +1,594 @@
+package kv2doc
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// SQLResult SQL 查询结果
+type SQLResult struct {
+	Docs    []Doc    // 查询到的文档，SELECT COUNT(*) 时为一个包含 count 字段的文档
+	Explain *Explain // EXPLAIN SELECT 时返回执行计划，不执行查询
+}
+
+// QuerySQL 使用类 SQL 语句查询，语句会被解析为 Query 执行
+// 支持 SELECT 字段列表（或 * 、COUNT(*)）、FROM、WHERE（AND、OR、括号、=、!=、<>、>、>=、<、<=、LIKE（可带 ESCAPE）、IN、NOT IN、IS NULL、IS NOT NULL）、ORDER BY、LIMIT、OFFSET
+// 语句以 EXPLAIN 开头时返回执行计划
+func (c *DB) QuerySQL(sql string) (*SQLResult, error) {
+	stmt, err := parseSQL(sql)
+	if err != nil {
+		return nil, err
+	}
+	query := c.Query(stmt.table)
+	if stmt.where != nil {
+		err = stmt.where.apply(query)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(stmt.orders) > 0 {
+		if stmt.desc {
+			query.Desc(stmt.orders...)
+		} else {
+			query.Asc(stmt.orders...)
+		}
+	}
+	if stmt.limit >= 0 {
+		query.Limit(stmt.offset, stmt.limit)
+	}
+	if len(stmt.fields) > 0 {
+		query.Select(stmt.fields...)
+	}
+	if stmt.explain {
+		explain := query.Explain()
+		return &SQLResult{
+			Explain: &explain,
+		}, nil
+	}
+	if stmt.count {
+		count, err := query.Count()
+		if err != nil {
+			return nil, err
+		}
+		return &SQLResult{
+			Docs: []Doc{{"count": strconv.FormatInt(count, 10)}},
+		}, nil
+	}
+	docs, err := query.List()
+	if err != nil {
+		return nil, err
+	}
+	return &SQLResult{
+		Docs: docs,
+	}, nil
+}
+
+type statement struct {
+	explain bool
+	count   bool
+	fields  []string
+	table   string
+	where   *condition
+	orders  []string
+	desc    bool
+	limit   int
+	offset  int
+}
+
+// 查询条件语法树，and/or/not 节点包含子条件，其他节点为单个字段的比较条件
+type condition struct {
+	operator string
+	children []*condition
+	field    string
+	values   []string
+}
+
+// 将条件添加到查询中，同一层的条件之间为交集
+func (c *condition) apply(query *Query) error {
+	switch c.operator {
+	case "and":
+		for _, v := range c.children {
+			if err := v.apply(query); err != nil {
+				return err
+			}
+		}
+	case "or":
+		// 每个分支合并为一个表达式，再以并集拼接
+		sc := Expr()
+		for _, v := range c.children {
+			branch := Expr()
+			if err := v.apply(branch); err != nil {
+				return err
+			}
+			sc.Must(branch)
+		}
+		query.Should(sc)
+	case "not":
+		sc := Expr()
+		if err := c.children[0].apply(sc); err != nil {
+			return err
+		}
+		query.Not(sc)
+	case "=":
+		query.Eq(c.field, c.values[0])
+	case "!=", "<>":
+		query.Ne(c.field, c.values[0])
+	case ">":
+		query.Gt(c.field, c.values[0])
+	case ">=":
+		query.Gte(c.field, c.values[0])
+	case "<":
+		query.Lt(c.field, c.values[0])
+	case "<=":
+		query.Lte(c.field, c.values[0])
+	case "in":
+		query.In(c.field, c.values...)
+	case "not in":
+		query.NotIn(c.field, c.values...)
+	case "is null":
+		query.NotExist(c.field)
+	case "is not null":
+		query.Exist(c.field)
+	case "like":
+		return like(query, c.field, c.values[0], c.values[1])
+	default:
+		return errors.New("sql: unsupported operator " + c.operator)
+	}
+	return nil
+}
+
+// LIKE 中 % 匹配任意个字符，_ 匹配一个字符，escape 不为空时其后的字符按原样匹配
+// 前缀（abc%）、后缀（%abc）、包含（%abc%）及精确匹配转为对应的查询条件，其余模式转为正则表达式（有固定前缀时同样会走索引）
+func like(query *Query, field, pattern, escape string) error {
+	var esc rune = -1
+	if len(escape) > 0 {
+		rs := []rune(escape)
+		if len(rs) != 1 {
+			return errors.New("sql: LIKE ESCAPE must be a single character")
+		}
+		esc = rs[0]
+	}
+	// 按 % 切分出的各段文本，wildcard 表示是否含有 _，同时生成等价的正则表达式
+	var parts []string
+	var part strings.Builder
+	regex := strings.Builder{}
+	regex.WriteString(`(?s)^`)
+	wildcard := false
+	rs := []rune(pattern)
+	for i := 0; i < len(rs); i++ {
+		switch r := rs[i]; {
+		case r == esc:
+			if i+1 >= len(rs) {
+				return errors.New("sql: LIKE pattern " + pattern + " ends with the escape character")
+			}
+			i++
+			part.WriteRune(rs[i])
+			regex.WriteString(regexp.QuoteMeta(string(rs[i])))
+		case r == '%':
+			parts = append(parts, part.String())
+			part.Reset()
+			regex.WriteString(`.*`)
+		case r == '_':
+			wildcard = true
+			regex.WriteString(`.`)
+		default:
+			part.WriteRune(r)
+			regex.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	parts = append(parts, part.String())
+	regex.WriteString(`$`)
+	// 去掉开头及结尾的 %，剩下一段不含通配符的文本时不需要正则表达式
+	suffix := len(parts) > 1 && len(parts[len(parts)-1]) <= 0
+	if suffix {
+		parts = parts[:len(parts)-1]
+	}
+	prefix := len(parts) > 1 && len(parts[0]) <= 0
+	if prefix {
+		parts = parts[1:]
+	}
+	if wildcard || len(parts) > 1 {
+		query.Regex(field, regex.String())
+		return nil
+	}
+	switch {
+	case prefix && suffix:
+		query.Like(field, parts[0])
+	case prefix:
+		query.RightLike(field, parts[0])
+	case suffix:
+		query.LeftLike(field, parts[0])
+	default:
+		query.Eq(field, parts[0])
+	}
+	return nil
+}
+
+// 比较符号
+var comparisons = map[string]bool{
+	"=": true, "!=": true, "<>": true, ">": true, ">=": true, "<": true, "<=": true,
+}
+
+// 词法单元类型
+const (
+	tokenWord = iota
+	tokenName // 用双引号或反引号括起来的字段名，不会被当作关键字
+	tokenString
+	tokenNumber
+	tokenSymbol
+)
+
+type token struct {
+	kind  int
+	value string
+}
+
+func (c token) is(kind int, value string) bool {
+	if c.kind != kind {
+		return false
+	}
+	if kind == tokenWord {
+		return strings.EqualFold(c.value, value)
+	}
+	return c.value == value
+}
+
+func lexSQL(sql string) ([]token, error) {
+	var tokens []token
+	rs := []rune(sql)
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '\'' || r == '"' || r == '`':
+			// 单引号为字符串，双引号和反引号为字段名，两个连续的引号表示引号本身
+			var sb strings.Builder
+			j := i + 1
+			for ; j < len(rs); j++ {
+				if rs[j] == r {
+					if j+1 < len(rs) && rs[j+1] == r {
+						sb.WriteRune(r)
+						j++
+						continue
+					}
+					break
+				}
+				sb.WriteRune(rs[j])
+			}
+			if j >= len(rs) {
+				return nil, errors.New("sql: unterminated quote")
+			}
+			kind := tokenName
+			if r == '\'' {
+				kind = tokenString
+			}
+			tokens = append(tokens, token{kind: kind, value: sb.String()})
+			i = j + 1
+		case unicode.IsDigit(r) || (r == '-' || r == '.') && i+1 < len(rs) && unicode.IsDigit(rs[i+1]):
+			j := i + 1
+			for j < len(rs) && (unicode.IsDigit(rs[j]) || rs[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, token{kind: tokenNumber, value: string(rs[i:j])})
+			i = j
+		case unicode.IsLetter(r) || r == '_':
+			j := i + 1
+			for j < len(rs) && (unicode.IsLetter(rs[j]) || unicode.IsDigit(rs[j]) || rs[j] == '_') {
+				j++
+			}
+			tokens = append(tokens, token{kind: tokenWord, value: string(rs[i:j])})
+			i = j
+		default:
+			// 两个字符的比较符号
+			if i+1 < len(rs) {
+				s := string(rs[i : i+2])
+				if s == "!=" || s == "<>" || s == ">=" || s == "<=" {
+					tokens = append(tokens, token{kind: tokenSymbol, value: s})
+					i += 2
+					continue
+				}
+			}
+			if !strings.ContainsRune("=<>(),*;", r) {
+				return nil, errors.New("sql: unexpected character " + string(r))
+			}
+			tokens = append(tokens, token{kind: tokenSymbol, value: string(r)})
+			i++
+		}
+	}
+	return tokens, nil
+}
+
+type sqlParser struct {
+	tokens []token
+	pos    int
+}
+
+func parseSQL(sql string) (*statement, error) {
+	tokens, err := lexSQL(sql)
+	if err != nil {
+		return nil, err
+	}
+	p := &sqlParser{
+		tokens: tokens,
+	}
+	stmt := &statement{
+		limit: -1,
+	}
+	if p.accept(tokenWord, "explain") {
+		stmt.explain = true
+	}
+	if err = p.expect(tokenWord, "select"); err != nil {
+		return nil, err
+	}
+	if p.accept(tokenSymbol, "*") {
+		// 返回全部字段
+	} else if p.peek().is(tokenWord, "count") && p.peekAt(1).is(tokenSymbol, "(") {
+		p.pos += 2
+		if err = p.expect(tokenSymbol, "*"); err != nil {
+			return nil, err
+		}
+		if err = p.expect(tokenSymbol, ")"); err != nil {
+			return nil, err
+		}
+		stmt.count = true
+	} else {
+		for {
+			field, err := p.word()
+			if err != nil {
+				return nil, err
+			}
+			stmt.fields = append(stmt.fields, field)
+			if !p.accept(tokenSymbol, ",") {
+				break
+			}
+		}
+	}
+	if err = p.expect(tokenWord, "from"); err != nil {
+		return nil, err
+	}
+	if stmt.table, err = p.word(); err != nil {
+		return nil, err
+	}
+	if p.accept(tokenWord, "where") {
+		if stmt.where, err = p.or(); err != nil {
+			return nil, err
+		}
+	}
+	if p.accept(tokenWord, "order") {
+		if err = p.expect(tokenWord, "by"); err != nil {
+			return nil, err
+		}
+		direction := ""
+		for {
+			field, err := p.word()
+			if err != nil {
+				return nil, err
+			}
+			stmt.orders = append(stmt.orders, field)
+			d := "asc"
+			if p.accept(tokenWord, "desc") {
+				d = "desc"
+			} else {
+				p.accept(tokenWord, "asc")
+			}
+			// 所有排序字段使用同一个排序方向
+			if len(direction) > 0 && direction != d {
+				return nil, errors.New("sql: mixed ORDER BY directions are not supported")
+			}
+			direction = d
+			if !p.accept(tokenSymbol, ",") {
+				break
+			}
+		}
+		stmt.desc = direction == "desc"
+	}
+	if p.accept(tokenWord, "limit") {
+		n, err := p.integer()
+		if err != nil {
+			return nil, err
+		}
+		stmt.limit = n
+		if p.accept(tokenSymbol, ",") {
+			// LIMIT offset, size
+			stmt.offset = n
+			if stmt.limit, err = p.integer(); err != nil {
+				return nil, err
+			}
+		} else if p.accept(tokenWord, "offset") {
+			if stmt.offset, err = p.integer(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	// 与 MySQL 相同，OFFSET 只能跟在 LIMIT n 之后
+	if p.peek().is(tokenWord, "offset") {
+		return nil, errors.New("sql: OFFSET must follow LIMIT n")
+	}
+	p.accept(tokenSymbol, ";")
+	if p.pos < len(p.tokens) {
+		return nil, errors.New("sql: unexpected " + p.tokens[p.pos].value)
+	}
+	return stmt, nil
+}
+
+func (c *sqlParser) or() (*condition, error) {
+	return c.list("or", c.and)
+}
+
+func (c *sqlParser) and() (*condition, error) {
+	return c.list("and", c.primary)
+}
+
+// 解析以 and 或 or 连接的多个条件，只有一个条件时直接返回该条件
+func (c *sqlParser) list(operator string, next func() (*condition, error)) (*condition, error) {
+	first, err := next()
+	if err != nil {
+		return nil, err
+	}
+	node := &condition{
+		operator: operator,
+		children: []*condition{first},
+	}
+	for c.accept(tokenWord, operator) {
+		child, err := next()
+		if err != nil {
+			return nil, err
+		}
+		node.children = append(node.children, child)
+	}
+	if len(node.children) == 1 {
+		return first, nil
+	}
+	return node, nil
+}
+
+func (c *sqlParser) primary() (*condition, error) {
+	if c.accept(tokenWord, "not") {
+		child, err := c.primary()
+		if err != nil {
+			return nil, err
+		}
+		return &condition{
+			operator: "not",
+			children: []*condition{child},
+		}, nil
+	}
+	if c.accept(tokenSymbol, "(") {
+		node, err := c.or()
+		if err != nil {
+			return nil, err
+		}
+		return node, c.expect(tokenSymbol, ")")
+	}
+	field, err := c.word()
+	if err != nil {
+		return nil, err
+	}
+	node := &condition{
+		field: field,
+	}
+	t := c.next()
+	switch {
+	case t.kind == tokenSymbol && comparisons[t.value]:
+		node.operator = t.value
+		value, err := c.literal()
+		if err != nil {
+			return nil, err
+		}
+		node.values = []string{value}
+	case t.is(tokenWord, "like"):
+		node.operator = "like"
+		value, err := c.literal()
+		if err != nil {
+			return nil, err
+		}
+		// 第二个值为转义字符，没有 ESCAPE 子句时为空
+		escape := ""
+		if c.accept(tokenWord, "escape") {
+			if escape, err = c.literal(); err != nil {
+				return nil, err
+			}
+		}
+		node.values = []string{value, escape}
+	case t.is(tokenWord, "in"):
+		node.operator = "in"
+		node.values, err = c.literals()
+	case t.is(tokenWord, "not") && c.accept(tokenWord, "in"):
+		node.operator = "not in"
+		node.values, err = c.literals()
+	case t.is(tokenWord, "is"):
+		node.operator = "is null"
+		if c.accept(tokenWord, "not") {
+			node.operator = "is not null"
+		}
+		err = c.expect(tokenWord, "null")
+	default:
+		return nil, errors.New("sql: unexpected " + t.value + " after " + field)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// 解析 (值, 值, ...)
+func (c *sqlParser) literals() ([]string, error) {
+	if err := c.expect(tokenSymbol, "("); err != nil {
+		return nil, err
+	}
+	var values []string
+	for {
+		value, err := c.literal()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+		if !c.accept(tokenSymbol, ",") {
+			break
+		}
+	}
+	return values, c.expect(tokenSymbol, ")")
+}
+
+func (c *sqlParser) literal() (string, error) {
+	t := c.next()
+	if t.kind != tokenString && t.kind != tokenNumber {
+		return "", errors.New("sql: expected value, got " + t.value)
+	}
+	return t.value, nil
+}
+
+func (c *sqlParser) integer() (int, error) {
+	t := c.next()
+	n, err := strconv.Atoi(t.value)
+	if t.kind != tokenNumber || err != nil || n < 0 {
+		return 0, errors.New("sql: expected non-negative integer, got " + t.value)
+	}
+	return n, nil
+}
+
+func (c *sqlParser) word() (string, error) {
+	t := c.next()
+	if t.kind != tokenWord && t.kind != tokenName {
+		return "", errors.New("sql: expected name, got " + t.value)
+	}
+	return t.value, nil
+}
+
+func (c *sqlParser) peek() token {
+	return c.peekAt(0)
+}
+
+func (c *sqlParser) peekAt(i int) token {
+	if c.pos+i < len(c.tokens) {
+		return c.tokens[c.pos+i]
+	}
+	return token{kind: tokenSymbol, value: "end of statement"}
+}
+
+func (c *sqlParser) next() token {
+	t := c.peek()
+	if c.pos < len(c.tokens) {
+		c.pos++
+	}
+	return t
+}
+
+func (c *sqlParser) accept(kind int, value string) bool {
+	if c.peek().is(kind, value) {
+		c.pos++
+		return true
+	}
+	return false
+}
+
+func (c *sqlParser) expect(kind int, value string) error {
+	if !c.accept(kind, value) {
+		return errors.New("sql: expected " + strings.ToUpper(value) + ", got " + c.peek().value)
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package kv2doc_test
+
+import (
+	"github.com/dpwgc/kv2doc"
+	"strings"
+	"testing"
+)
+
+func TestQuerySQL(t *testing.T) {
+	db, _ := newTestDB(t)
+	addDocs(t, db, "products",
+		kv2doc.Doc{"name": "apple", "kind": "fruit", "price": "3"},
+		kv2doc.Doc{"name": "banana", "kind": "fruit", "price": "1.5"},
+		kv2doc.Doc{"name": "carrot", "kind": "vegetable", "price": "0.8"},
+		kv2doc.Doc{"name": "apricot", "kind": "fruit", "price": "12"},
+		kv2doc.Doc{"name": "tomato", "kind": "vegetable"},
+	)
+
+	tests := []struct {
+		sql  string
+		want string
+	}{
+		{`select name from products where kind = 'fruit' order by price`, "banana,apple,apricot"},
+		{`SELECT * FROM products WHERE kind = 'vegetable' OR name = 'apricot' ORDER BY name DESC`, "tomato,carrot,apricot"},
+		{`select * from products where (kind = 'fruit' and price < 5) or name = 'carrot' order by name`, "apple,banana,carrot"},
+		{`select * from products where name in ('apple', 'tomato', 'kiwi') order by name`, "apple,tomato"},
+		{`select * from products where name not in ('apple', 'banana') and price is not null order by name`, "apricot,carrot"},
+		{`select * from products where price is null`, "tomato"},
+		{`select * from products where not (kind = 'fruit' or name = 'tomato')`, "carrot"},
+		{`select * from products where kind = 'fruit' and not price > 2 order by name`, "banana"},
+		{`select * from products where name like 'ap%' order by name`, "apple,apricot"},
+		{`select * from products where name like '%ato'`, "tomato"},
+		{`select * from products where name like '%rr%'`, "carrot"},
+		{`select * from products where name like '_pp%'`, "apple"},
+		{`select * from products where name like 'ap_i%' order by name`, "apricot"},
+		{`select * from products where name like '%r_o%'`, "carrot"},
+		{`select * from products where name like '%a%o'`, "tomato"},
+		{`select * from products where "name" <> 'apple' and kind != 'vegetable' order by name`, "apricot,banana"},
+		{`select * from products order by name limit 2 offset 1`, "apricot,banana"},
+		{`select * from products order by name limit 3, 5`, "carrot,tomato"},
+		{`select count(*) from products where kind = 'fruit'`, "count=3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sql, func(t *testing.T) {
+			result, err := db.QuerySQL(tt.sql)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, v := range result.Docs {
+				if n, ok := v["count"]; ok {
+					got = append(got, "count="+n)
+					continue
+				}
+				got = append(got, v["name"])
+			}
+			if strings.Join(got, ",") != tt.want {
+				t.Errorf("got %v, want %s", got, tt.want)
+			}
+		})
+	}
+
+	// 只返回选中的字段
+	result, err := db.QuerySQL(`select name from products where name = 'apple'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Docs) != 1 || result.Docs[0].HasField("kind") {
+		t.Errorf("Docs = %v, want only the selected fields", result.Docs)
+	}
+}
+
+func TestQuerySQLExplain(t *testing.T) {
+	db, _ := newTestDB(t)
+	for _, v := range []string{"apple", "banana", "carrot"} {
+		addDocs(t, db, "products", kv2doc.Doc{"name": v})
+	}
+
+	result, err := db.QuerySQL(`explain select * from products where name = 'apple'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Explain == nil || len(result.Docs) > 0 {
+		t.Fatalf("result = %+v, want only an execution plan", result)
+	}
+	if result.Explain.Plan.Access != "index" || result.Explain.Index.String() != "f/name/apple/" {
+		t.Errorf("Plan = %+v, want an index scan on name", result.Explain.Plan)
+	}
+}
+
+// LIKE 的 _ 匹配一个字符，ESCAPE 指定的转义字符之后的 % 和 _ 按原样匹配
+func TestQuerySQLLike(t *testing.T) {
+	db, _ := newTestDB(t)
+	for _, v := range []string{"50% off", "50 off", "a_b", "axb", "ab", "_x"} {
+		addDocs(t, db, "coupons", kv2doc.Doc{"name": v})
+	}
+
+	tests := []struct {
+		sql  string
+		want string
+	}{
+		{`select * from coupons where name like '50!%%' escape '!' order by name`, "50% off"},
+		{`select * from coupons where name like '50%' order by name`, "50 off,50% off"},
+		{`select * from coupons where name like 'a\_b' escape '\'`, "a_b"},
+		{`select * from coupons where name like 'a_b' order by name`, "a_b,axb"},
+		{`select * from coupons where name like 'a__' escape 'a'`, "_x"},
+		{`select * from coupons where name like '%!_%' escape '!' order by name`, "_x,a_b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sql, func(t *testing.T) {
+			result, err := db.QuerySQL(tt.sql)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, v := range result.Docs {
+				got = append(got, v["name"])
+			}
+			if strings.Join(got, ",") != tt.want {
+				t.Errorf("got %v, want %s", got, tt.want)
+			}
+		})
+	}
+
+	// 带有固定前缀的模式按前缀扫描字段索引
+	result, err := db.QuerySQL(`explain select * from coupons where name like '50_o%'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Explain.Index.String() != "f/name/50" {
+		t.Errorf("Index = %s, want a prefix scan of f/name/50", result.Explain.Index.String())
+	}
+}
+
+func TestQuerySQLErrors(t *testing.T) {
+	db, _ := newTestDB(t)
+	addDocs(t, db, "products", kv2doc.Doc{"name": "apple"})
+
+	tests := []struct {
+		name string
+		sql  string
+		// 错误信息中应当包含的内容
+		want string
+	}{
+		{"empty", ``, "sql:"},
+		{"not select", `delete from products`, "sql:"},
+		{"missing from", `select * products`, "sql:"},
+		{"missing table", `select * from`, "sql:"},
+		{"bad count", `select count(name) from products`, "sql:"},
+		{"unterminated string", `select * from products where name = 'apple`, "sql:"},
+		{"missing value", `select * from products where name =`, "sql:"},
+		{"unknown operator", `select * from products where name ~ 'apple'`, "sql:"},
+		{"unclosed paren", `select * from products where (name = 'apple'`, "sql:"},
+		{"empty in", `select * from products where name in ()`, "sql:"},
+		{"long escape", `select * from products where name like 'a%' escape '!!'`, "ESCAPE"},
+		{"trailing escape", `select * from products where name like 'a!' escape '!'`, "escape"},
+		{"missing escape", `select * from products where name like 'a%' escape`, "sql:"},
+		{"negative limit", `select * from products limit -1`, "sql:"},
+		{"trailing tokens", `select * from products limit 1 2`, "sql:"},
+		{"offset without limit", `select * from products offset 1`, "OFFSET"},
+		{"offset after comma limit", `select * from products limit 1, 2 offset 1`, "OFFSET"},
+		{"offset twice", `select * from products limit 1 offset 1 offset 2`, "OFFSET"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := db.QuerySQL(tt.sql)
+			if err == nil {
+				t.Fatalf("QuerySQL(%q) = %v, want error", tt.sql, result)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("QuerySQL(%q) error = %q, want it to contain %q", tt.sql, err, tt.want)
+			}
+		})
+	}
+}
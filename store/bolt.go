@@ -46,6 +46,7 @@ func (c *Bolt) DropTable(table string) (err error) {
 	if len(table) <= 0 {
 		return nil
 	}
+	delete(c.tableExists, table)
 	return c.db.Update(func(tx *bolt.Tx) error {
 		return tx.DeleteBucket([]byte(table))
 	})
@@ -101,16 +102,20 @@ func (c *Bolt) ScanKV(table, prefix string, logic func(key string, value []byte)
 		return nil
 	}
 	return c.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(table))
+		if bucket == nil {
+			return nil
+		}
 		if len(prefix) > 0 {
 			pbs := []byte(prefix)
-			cur := tx.Bucket([]byte(table)).Cursor()
+			cur := bucket.Cursor()
 			for k, v := cur.Seek(pbs); k != nil && bytes.HasPrefix(k, pbs); k, v = cur.Next() {
 				if !logic(string(k), v) {
 					return nil
 				}
 			}
 		} else {
-			cur := tx.Bucket([]byte(table)).Cursor()
+			cur := bucket.Cursor()
 			for k, v := cur.First(); k != nil; k, v = cur.Next() {
 				if !logic(string(k), v) {
 					return nil
@@ -121,6 +126,37 @@ func (c *Bolt) ScanKV(table, prefix string, logic func(key string, value []byte)
 	})
 }
 
+func (c *Bolt) RangeKV(table, start, end string, logic func(key string, value []byte) bool) error {
+	if len(table) <= 0 || logic == nil {
+		return nil
+	}
+	return c.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(table))
+		if bucket == nil {
+			return nil
+		}
+		ebs := []byte(end)
+		cur := bucket.Cursor()
+		for k, v := cur.Seek([]byte(start)); k != nil && bytes.Compare(k, ebs) < 0; k, v = cur.Next() {
+			if !logic(string(k), v) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+// View 开启一个只读事务作为快照，快照关闭前数据库文件无法扩容，写入可能会等待快照关闭
+func (c *Bolt) View() (Snapshot, error) {
+	tx, err := c.db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	return &boltSnapshot{
+		tx: tx,
+	}, nil
+}
+
 func (c *Bolt) NextID(table string) (id string, err error) {
 	err = c.db.Update(func(tx *bolt.Tx) error {
 		id64, err := tx.Bucket([]byte(table)).NextSequence()
@@ -132,3 +168,62 @@ func (c *Bolt) NextID(table string) (id string, err error) {
 	})
 	return id, err
 }
+
+// Bolt 的只读快照，所有读取都在同一个读事务中完成
+type boltSnapshot struct {
+	tx *bolt.Tx
+}
+
+func (c *boltSnapshot) GetKV(table, key string) (kv KV, err error) {
+	if len(table) <= 0 || len(key) <= 0 {
+		return KV{}, nil
+	}
+	bucket := c.tx.Bucket([]byte(table))
+	if bucket == nil {
+		return KV{}, nil
+	}
+	return KV{
+		Key:   key,
+		Value: bucket.Get([]byte(key)),
+	}, nil
+}
+
+func (c *boltSnapshot) ScanKV(table, prefix string, logic func(key string, value []byte) bool) error {
+	if len(table) <= 0 || logic == nil {
+		return nil
+	}
+	bucket := c.tx.Bucket([]byte(table))
+	if bucket == nil {
+		return nil
+	}
+	pbs := []byte(prefix)
+	cur := bucket.Cursor()
+	for k, v := cur.Seek(pbs); k != nil && bytes.HasPrefix(k, pbs); k, v = cur.Next() {
+		if !logic(string(k), v) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (c *boltSnapshot) RangeKV(table, start, end string, logic func(key string, value []byte) bool) error {
+	if len(table) <= 0 || logic == nil {
+		return nil
+	}
+	bucket := c.tx.Bucket([]byte(table))
+	if bucket == nil {
+		return nil
+	}
+	ebs := []byte(end)
+	cur := bucket.Cursor()
+	for k, v := cur.Seek([]byte(start)); k != nil && bytes.Compare(k, ebs) < 0; k, v = cur.Next() {
+		if !logic(string(k), v) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (c *boltSnapshot) Close() error {
+	return c.tx.Rollback()
+}
@@ -9,6 +9,11 @@ type Store interface {
 	NextID(table string) (id string, err error)
 }
 
+// Ranger 可选实现的区间扫描接口（包含 start，不包含 end），存储引擎未实现时会退化为前缀扫描
+type Ranger interface {
+	RangeKV(table, start, end string, logic func(key string, value []byte) bool) (err error)
+}
+
 type KV struct {
 	Key   string
 	Value []byte
@@ -21,3 +26,16 @@ func (c KV) HasKey() bool {
 func (c KV) HasValue() bool {
 	return len(c.Value) > 0
 }
+
+// Viewer 可选实现的只读快照接口，快照在 Close 之前一直持有存储的读事务，之后的写入对快照不可见
+type Viewer interface {
+	View() (snapshot Snapshot, err error)
+}
+
+// Snapshot 只读快照，各方法与 Store、Ranger 中的同名方法相同，使用完毕后必须调用 Close
+type Snapshot interface {
+	GetKV(table, key string) (kv KV, err error)
+	ScanKV(table, prefix string, logic func(key string, value []byte) bool) (err error)
+	RangeKV(table, start, end string, logic func(key string, value []byte) bool) (err error)
+	Close() (err error)
+}
@@ -0,0 +1,123 @@
+package kv2doc
+
+import (
+	"fmt"
+	"github.com/dpwgc/kv2doc/store"
+	"time"
+)
+
+const (
+	timePrefix = "t"
+	// 已完整建立的索引标记
+	builtPrefix = "b"
+)
+
+// CreatedBetween 创建时间在指定区间内（包含起止时间），会走时间索引
+func (c *Query) CreatedBetween(from, to time.Time) *Query {
+	return c.between(createdAt, from.UnixMilli(), to.UnixMilli(), true, true)
+}
+
+// CreatedSince 创建时间不早于指定时间，会走时间索引
+func (c *Query) CreatedSince(from time.Time) *Query {
+	return c.between(createdAt, from.UnixMilli(), 0, true, false)
+}
+
+// UpdatedBetween 更新时间在指定区间内（包含起止时间），会走时间索引
+func (c *Query) UpdatedBetween(from, to time.Time) *Query {
+	return c.between(updatedAt, from.UnixMilli(), to.UnixMilli(), true, true)
+}
+
+// UpdatedSince 更新时间不早于指定时间，会走时间索引
+func (c *Query) UpdatedSince(from time.Time) *Query {
+	return c.between(updatedAt, from.UnixMilli(), 0, true, false)
+}
+
+// 时间区间条件（包含两端），hasFrom、hasTo 为 false 时表示没有下限、上限
+func (c *Query) between(field string, from, to int64, hasFrom, hasTo bool) *Query {
+	switch {
+	case hasFrom && hasTo:
+		c.add(fmt.Sprintf(`(float(%s) >= %d && float(%s) <= %d)`, field, from, field, to))
+		c.record(map[string]any{field: map[string]any{opGte: from, opLte: to}})
+	case hasFrom:
+		c.add(fmt.Sprintf(`(float(%s) >= %d)`, field, from))
+		c.recordOp(field, opGte, from)
+	case hasTo:
+		c.add(fmt.Sprintf(`(float(%s) <= %d)`, field, to))
+		c.recordOp(field, opLte, to)
+	default:
+		return c
+	}
+	if hasFrom && hasTo && to < from {
+		return c
+	}
+	index := Index{
+		field:    field,
+		value:    toPath(timePrefix, field, ""),
+		operator: timeRange,
+		// '~' 大于所有数字，作为没有上限时的结束 key
+		end: toPath(timePrefix, field, "~"),
+	}
+	if hasFrom {
+		index.value = toPath(timePrefix, field, toTime(from))
+	}
+	if hasTo {
+		index.end = toPath(timePrefix, field, toTime(to+1))
+	}
+	c.last().indexes = append(c.last().indexes, index)
+	return c
+}
+
+// 定长的毫秒时间戳，保证字典序与时间顺序一致
+func toTime(ms int64) string {
+	return fmt.Sprintf("%020d", ms)
+}
+
+// 区间扫描（包含 start，不包含 end），存储引擎没有实现 store.Ranger 时，按公共前缀扫描后过滤
+func (c *DB) rangeKV(table, start, end string, logic func(key string, value []byte) bool) error {
+	if r, ok := c.store.(store.Ranger); ok {
+		return r.RangeKV(table, start, end, logic)
+	}
+	i := 0
+	for i < len(start) && i < len(end) && start[i] == end[i] {
+		i++
+	}
+	return c.store.ScanKV(table, start[:i], func(key string, value []byte) bool {
+		if key < start {
+			return true
+		}
+		if key >= end {
+			return false
+		}
+		return logic(key, value)
+	})
+}
+
+// 时间索引是否已完整建立（空表写入第一个文档时，或执行 Reindex 后写入标记）
+// 没有标记时，升级前写入的文档可能缺少时间索引
+func (c *DB) timeIndexed(table string) bool {
+	kv, err := c.store.GetKV(table, toPath(builtPrefix, timePrefix))
+	return err == nil && kv.HasValue()
+}
+
+// 表中还没有文档时返回时间索引的标记，之后写入的文档都会建立时间索引
+func (c *DB) timeMarker(table string) ([]store.KV, error) {
+	if c.timeIndexed(table) {
+		return nil, nil
+	}
+	empty := true
+	err := c.store.ScanKV(table, toPath(primaryPrefix, primaryKey, ""), func(key string, value []byte) bool {
+		empty = false
+		return false
+	})
+	if err != nil || !empty {
+		return nil, err
+	}
+	return []store.KV{timeBuilt()}, nil
+}
+
+func timeBuilt() store.KV {
+	return store.KV{
+		Key:   toPath(builtPrefix, timePrefix),
+		Value: []byte("1"),
+	}
+}
@@ -0,0 +1,110 @@
+package kv2doc_test
+
+import (
+	"fmt"
+	"github.com/dpwgc/kv2doc"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestTimeRange(t *testing.T) {
+	db, _ := newTestDB(t)
+	// 依次写入 a、b、c，记录每次写入之间的时间点
+	var marks []time.Time
+	for _, v := range []string{"a", "b", "c"} {
+		marks = append(marks, time.Now())
+		time.Sleep(3 * time.Millisecond)
+		addDocs(t, db, "events", kv2doc.Doc{"name": v})
+		time.Sleep(3 * time.Millisecond)
+	}
+	marks = append(marks, time.Now())
+	time.Sleep(3 * time.Millisecond)
+	// 修改 a 之后，a 的更新时间晚于所有创建时间
+	docs, err := db.Query("events").Eq("name", "a").List()
+	if err != nil || len(docs) != 1 {
+		t.Fatalf("List() = %v, %v", docs, err)
+	}
+	if err = db.Edit("events", docs[0].ID(), kv2doc.Doc{"name": "a", "edited": "1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		query *kv2doc.Query
+		want  []string
+	}{
+		{"created between", db.Query("events").CreatedBetween(marks[1], marks[2]), []string{"b"}},
+		{"created between all", db.Query("events").CreatedBetween(marks[0], marks[3]), []string{"a", "b", "c"}},
+		{"created since", db.Query("events").CreatedSince(marks[1]), []string{"b", "c"}},
+		{"updated since", db.Query("events").UpdatedSince(marks[3]), []string{"a"}},
+		{"updated between", db.Query("events").UpdatedBetween(marks[1], marks[3]), []string{"b", "c"}},
+		{"reversed range", db.Query("events").CreatedBetween(marks[3], marks[0]), nil},
+		{"with other condition", db.Query("events").CreatedSince(marks[0]).Eq("edited", "1"), []string{"a"}},
+		{"before 1970", db.Query("events").CreatedBetween(time.UnixMilli(-1000), marks[1]), []string{"a"}},
+		{"time before", db.Query("events").TimeBefore("_created", fmt.Sprint(marks[2].UnixMilli())), []string{"a", "b"}},
+		{"time after", db.Query("events").TimeAfter("_created", fmt.Sprint(marks[1].UnixMilli())), []string{"b", "c"}},
+		{"filter upper bound only", db.Find("events", fmt.Sprintf(`{"_created": {"$lte": %d}}`, marks[1].UnixMilli())), []string{"a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			docs, err := tt.query.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, v := range docs {
+				got = append(got, v["name"])
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// 只扫描区间内的时间索引 key
+	for _, query := range []*kv2doc.Query{
+		db.Query("events").CreatedBetween(marks[1], marks[2]),
+		db.Query("events").TimeBefore("_created", fmt.Sprint(marks[1].UnixMilli())),
+	} {
+		analysis, err := query.ExplainAnalyze()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if analysis.Plan.Access != "range" || analysis.Keys != 1 || analysis.Returned != 1 {
+			t.Errorf("Plan = %+v, Keys = %d, Returned = %d, want a range scan of 1 key", analysis.Plan, analysis.Keys, analysis.Returned)
+		}
+	}
+}
+
+func TestTimeRangeWithoutIndex(t *testing.T) {
+	db, s := newTestDB(t)
+	for i := 0; i < 9; i++ {
+		addDocs(t, db, "users", kv2doc.Doc{"name": "old"})
+	}
+	time.Sleep(3 * time.Millisecond)
+	since := time.Now()
+	time.Sleep(3 * time.Millisecond)
+	addDocs(t, db, "users", kv2doc.Doc{"name": "new"})
+	// 模拟升级前写入的表：没有时间索引，也没有建立完成的标记
+	deleteKeys(t, s, append(scanKeys(t, s, "t/"), "b/t")...)
+
+	if explain := db.Query("users").CreatedSince(since).Explain(); explain.Plan.Access != "scan" {
+		t.Errorf("Plan = %+v, want a full scan before Reindex", explain.Plan)
+	}
+	if n, err := db.Query("users").CreatedSince(since).Count(); err != nil || n != 1 {
+		t.Errorf("Count() = %d, %v, want 1", n, err)
+	}
+
+	if err := db.Reindex("users"); err != nil {
+		t.Fatal(err)
+	}
+	if explain := db.Query("users").CreatedSince(since).Explain(); explain.Plan.Access != "range" {
+		t.Errorf("Plan = %+v, want a range scan after Reindex", explain.Plan)
+	}
+	if n, err := db.Query("users").CreatedSince(since).Count(); err != nil || n != 1 {
+		t.Errorf("Count() = %d, %v, want 1", n, err)
+	}
+}
@@ -0,0 +1,409 @@
+package kv2doc
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"github.com/dpwgc/kv2doc/store"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	vectorPrefix   = "v"
+	centroidPrefix = "c"
+	// 训练聚类中心时最多采样的向量数量
+	vectorSample = 10000
+	// 训练聚类中心时的迭代次数
+	kmeansRounds = 10
+)
+
+// 向量相似度计算方式
+const (
+	Cosine = iota // 余弦相似度
+	Dot           // 点积
+	L2            // 欧氏距离
+)
+
+type nearest struct {
+	field  string
+	vector []float64
+	k      int
+	metric int
+	// 向量索引条件，不是筛选条件，不属于条件树
+	index *Index
+}
+
+// Nearest 相似度查询，返回与指定向量最相似的 k 个文档，结果按相似度由高到低排序
+// 其他查询条件会先对文档进行筛选，再在筛选结果中计算相似度
+// 字段定义了近似索引（Lists 大于 0）时，可能会只扫描与查询向量最近的若干个聚类
+func (c *Query) Nearest(field string, vector []float64, k int, metric int) *Query {
+	if c.isChild || len(field) <= 0 || len(vector) <= 0 || k <= 0 {
+		return c
+	}
+	c.opaque("Nearest")
+	c.nearest = &nearest{
+		field:  field,
+		vector: vector,
+		k:      k,
+		metric: metric,
+	}
+	if c.db != nil {
+		c.selectVectorIndex(field, vector)
+	}
+	return c
+}
+
+func (c *Query) selectVectorIndex(field string, target []float64) {
+	schema, err := c.db.schema(c.table)
+	if err != nil || schema[field].Type != Vector || schema[field].Lists <= 0 {
+		return
+	}
+	trained := c.db.centroidsOf(c.table, field)
+	centroids := trained.Centroids
+	if len(centroids) <= 0 {
+		return
+	}
+	probes := schema[field].Probes
+	if probes <= 0 {
+		probes = schema[field].Lists / 4
+	}
+	if probes <= 0 {
+		probes = 1
+	}
+	// 选出与查询向量最近的若干个聚类
+	lists := make([]int, len(centroids))
+	for i := range lists {
+		lists[i] = i
+	}
+	sort.SliceStable(lists, func(i, j int) bool {
+		return l2(centroids[lists[i]], target) < l2(centroids[lists[j]], target)
+	})
+	if len(lists) > probes {
+		lists = lists[:probes]
+	}
+	index := Index{
+		field:    field,
+		operator: vector,
+	}
+	for _, v := range lists {
+		index.union = append(index.union, Index{
+			field:    field,
+			value:    trained.list(v),
+			operator: vector,
+		})
+	}
+	c.nearest.index = &index
+}
+
+// 解析 "[0.1,0.2,0.3]" 或者 "0.1,0.2,0.3" 格式的向量，dim 大于 0 时校验维度
+func toVector(s string, dim int) ([]float64, bool) {
+	s = strings.TrimSpace(s)
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	if len(s) <= 0 {
+		return nil, false
+	}
+	parts := strings.Split(s, ",")
+	if dim > 0 && len(parts) != dim {
+		return nil, false
+	}
+	vector := make([]float64, len(parts))
+	for i, v := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return nil, false
+		}
+		vector[i] = f
+	}
+	return vector, true
+}
+
+// 计算相似度，数值越大越相似
+func similarity(metric int, a, b []float64) float64 {
+	switch metric {
+	case Dot:
+		return dot(a, b)
+	case L2:
+		return -l2(a, b)
+	default:
+		na, nb := math.Sqrt(dot(a, a)), math.Sqrt(dot(b, b))
+		if na == 0 || nb == 0 {
+			return 0
+		}
+		return dot(a, b) / (na * nb)
+	}
+}
+
+func dot(a, b []float64) float64 {
+	var s float64
+	for i := range a {
+		s += a[i] * b[i]
+	}
+	return s
+}
+
+func l2(a, b []float64) float64 {
+	var s float64
+	for i := range a {
+		d := a[i] - b[i]
+		s += d * d
+	}
+	return math.Sqrt(s)
+}
+
+func toList(i int) string {
+	return fmt.Sprintf("%04d", i)
+}
+
+// 向量字段训练得到的聚类中心，Gen 为训练的批次
+// 倒排列表名带有批次，重新训练期间新旧两批列表互不影响
+type ivf struct {
+	Gen       int
+	Centroids [][]float64
+}
+
+// 第 i 个聚类的倒排列表名，批次为 0 时（升级前训练的聚类中心）不带批次
+func (c ivf) list(i int) string {
+	if c.Gen <= 0 {
+		return toList(i)
+	}
+	return strconv.Itoa(c.Gen) + "-" + toList(i)
+}
+
+// 保留相似度最高的 k 个文档
+type ranker struct {
+	nearest nearest
+	items   rankHeap
+	pushed  int
+}
+
+type rankItem struct {
+	doc   Doc
+	score float64
+}
+
+// 按相似度排序的小顶堆，堆顶是当前相似度最低的文档
+type rankHeap []rankItem
+
+func (h rankHeap) Len() int           { return len(h) }
+func (h rankHeap) Less(i, j int) bool { return h[i].score < h[j].score }
+func (h rankHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *rankHeap) Push(x any)        { *h = append(*h, x.(rankItem)) }
+func (h *rankHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+func newRanker(n nearest) *ranker {
+	return &ranker{
+		nearest: n,
+	}
+}
+
+func (c *ranker) push(doc Doc) {
+	v, ok := toVector(doc[c.nearest.field], len(c.nearest.vector))
+	if !ok {
+		return
+	}
+	c.pushed++
+	score := similarity(c.nearest.metric, v, c.nearest.vector)
+	if len(c.items) < c.nearest.k {
+		heap.Push(&c.items, rankItem{doc: doc, score: score})
+	} else if score > c.items[0].score {
+		c.items[0] = rankItem{doc: doc, score: score}
+		heap.Fix(&c.items, 0)
+	}
+}
+
+// 参与排序的候选文档数量
+func (c *ranker) size() int {
+	return c.pushed
+}
+
+// 按相似度由高到低返回文档
+func (c *ranker) result() []Doc {
+	sort.SliceStable(c.items, func(i, j int) bool {
+		return c.items[i].score > c.items[j].score
+	})
+	docs := make([]Doc, 0, len(c.items))
+	for _, v := range c.items {
+		docs = append(docs, v.doc)
+	}
+	return docs
+}
+
+// 读取向量字段的聚类中心，读取后缓存在内存中
+func (c *DB) centroidsOf(table, field string) ivf {
+	key := toPath(table, field)
+	if v, ok := c.centroids.Load(key); ok {
+		return v.(ivf)
+	}
+	var trained ivf
+	kv, err := c.store.GetKV(table, toPath(centroidPrefix, field))
+	if err != nil {
+		return ivf{}
+	}
+	if kv.HasValue() {
+		if kv.Value[0] == '[' {
+			// 升级前只保存了聚类中心
+			_ = json.Unmarshal(kv.Value, &trained.Centroids)
+		} else {
+			_ = json.Unmarshal(kv.Value, &trained)
+		}
+	}
+	c.centroids.Store(key, trained)
+	return trained
+}
+
+// 计算向量所属的倒排列表，重新训练期间同时返回新旧两批聚类中心对应的列表
+func (c *DB) assign(table string, field Field, value string) (lists []string) {
+	trained := []ivf{c.centroidsOf(table, field.Name)}
+	if v, ok := c.staged.Load(toPath(table, field.Name)); ok {
+		trained = append(trained, v.(ivf))
+	}
+	for _, t := range trained {
+		if len(t.Centroids) <= 0 {
+			continue
+		}
+		if v, ok := toVector(value, len(t.Centroids[0])); ok {
+			lists = append(lists, t.list(closest(t.Centroids, v)))
+		}
+	}
+	return lists
+}
+
+func closest(centroids [][]float64, v []float64) int {
+	best, min := 0, math.MaxFloat64
+	for i, cv := range centroids {
+		if d := l2(cv, v); d < min {
+			best, min = i, d
+		}
+	}
+	return best
+}
+
+// 根据表中现有的数据，训练所有向量字段的聚类中心
+// 新的聚类中心先暂存，写入的文档同时建立新旧两批倒排列表，重建完成后调用 publish 替换旧的聚类中心
+func (c *DB) train(table string) (staged map[string]ivf, err error) {
+	schema, err := c.schema(table)
+	if err != nil {
+		return nil, err
+	}
+	staged = make(map[string]ivf)
+	for _, field := range schema {
+		if field.Type != Vector {
+			continue
+		}
+		trained := ivf{
+			Gen: c.centroidsOf(table, field.Name).Gen + 1,
+		}
+		if field.Lists > 0 {
+			var samples [][]float64
+			err = c.store.ScanKV(table, toPath(primaryPrefix, primaryKey, ""), func(key string, value []byte) bool {
+				doc := Doc{}.FromBytes(value)
+				if v, ok := toVector(doc[field.Name], field.Dim); ok && (len(samples) <= 0 || len(v) == len(samples[0])) {
+					samples = append(samples, v)
+				}
+				return len(samples) < vectorSample
+			})
+			if err != nil {
+				return nil, err
+			}
+			trained.Centroids = kmeans(samples, field.Lists)
+		}
+		staged[field.Name] = trained
+	}
+	c.stage(table, staged)
+	return staged, nil
+}
+
+// 暂存新的聚类中心，staged 为 nil 时清除暂存
+func (c *DB) stage(table string, staged map[string]ivf) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.staged.Range(func(key, value any) bool {
+		if strings.HasPrefix(key.(string), table+"/") {
+			c.staged.Delete(key)
+		}
+		return true
+	})
+	for field, v := range staged {
+		c.staged.Store(toPath(table, field), v)
+	}
+}
+
+// 保存暂存的聚类中心，替换旧的聚类中心，旧的倒排列表成为孤立索引
+func (c *DB) publish(table string, staged map[string]ivf) error {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var kvs []store.KV
+	for field, v := range staged {
+		kv := store.KV{
+			Key: toPath(centroidPrefix, field),
+		}
+		if len(v.Centroids) > 0 {
+			bs, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			kv.Value = bs
+		}
+		kvs = append(kvs, kv)
+	}
+	err := c.store.SetKV(table, kvs)
+	if err != nil {
+		return err
+	}
+	for field, v := range staged {
+		c.centroids.Store(toPath(table, field), v)
+		c.staged.Delete(toPath(table, field))
+	}
+	return nil
+}
+
+// k-means 聚类
+func kmeans(samples [][]float64, k int) [][]float64 {
+	if len(samples) <= 0 {
+		return nil
+	}
+	if k > len(samples) {
+		k = len(samples)
+	}
+	dim := len(samples[0])
+	centroids := make([][]float64, k)
+	for i := range centroids {
+		centroids[i] = append([]float64{}, samples[i*len(samples)/k]...)
+	}
+	for round := 0; round < kmeansRounds; round++ {
+		sums := make([][]float64, k)
+		counts := make([]int, k)
+		for i := range sums {
+			sums[i] = make([]float64, dim)
+		}
+		for _, v := range samples {
+			i := closest(centroids, v)
+			counts[i]++
+			for j := range v {
+				sums[i][j] += v[j]
+			}
+		}
+		for i := range centroids {
+			// 空的聚类保留原来的中心
+			if counts[i] <= 0 {
+				continue
+			}
+			for j := range sums[i] {
+				centroids[i][j] = sums[i][j] / float64(counts[i])
+			}
+		}
+	}
+	return centroids
+}
@@ -0,0 +1,175 @@
+package kv2doc_test
+
+import (
+	"fmt"
+	"github.com/dpwgc/kv2doc"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNearestExact(t *testing.T) {
+	db, _ := newTestDB(t)
+	if err := db.Define("articles", kv2doc.Field{Name: "embedding", Type: kv2doc.Vector, Dim: 2}); err != nil {
+		t.Fatal(err)
+	}
+	addDocs(t, db, "articles",
+		kv2doc.Doc{"title": "east", "lang": "en", "embedding": "[1,0]"},
+		kv2doc.Doc{"title": "far east", "lang": "en", "embedding": "[4,0.4]"},
+		kv2doc.Doc{"title": "north", "lang": "en", "embedding": "[0,1]"},
+		kv2doc.Doc{"title": "north east", "lang": "zh", "embedding": "[1,1]"},
+		kv2doc.Doc{"title": "wrong dim", "lang": "en", "embedding": "[1,0,0]"},
+		kv2doc.Doc{"title": "no vector", "lang": "en"},
+	)
+
+	tests := []struct {
+		name  string
+		query *kv2doc.Query
+		want  []string
+	}{
+		// 余弦相似度只看方向，far east 与 [1,0.1] 方向相同
+		{"cosine", db.Query("articles").Nearest("embedding", []float64{1, 0.1}, 3, kv2doc.Cosine), []string{"far east", "east", "north east"}},
+		// 欧氏距离同时考虑长度
+		{"l2", db.Query("articles").Nearest("embedding", []float64{1, 0.1}, 3, kv2doc.L2), []string{"east", "north east", "north"}},
+		{"dot", db.Query("articles").Nearest("embedding", []float64{1, 0.1}, 1, kv2doc.Dot), []string{"far east"}},
+		// 先按其他条件筛选，再计算相似度
+		{"filtered", db.Query("articles").Eq("lang", "zh").Nearest("embedding", []float64{1, 0}, 3, kv2doc.Cosine), []string{"north east"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			docs, err := tt.query.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, v := range docs {
+				got = append(got, v["title"])
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNearestIVF(t *testing.T) {
+	db, _ := newTestDB(t)
+	// 四组相距很远的向量，每组 5 个
+	centers := [][2]float64{{0, 0}, {100, 0}, {0, 100}, {100, 100}}
+	for i, c := range centers {
+		for j := 0; j < 5; j++ {
+			addDocs(t, db, "points", kv2doc.Doc{
+				"group":  fmt.Sprint(i),
+				"vector": fmt.Sprintf("[%g,%g]", c[0]+float64(j), c[1]-float64(j)),
+			})
+		}
+	}
+	// 定义字段时根据现有数据训练聚类中心，每个聚类正好是一组向量
+	if err := db.Define("points", kv2doc.Field{Name: "vector", Type: kv2doc.Vector, Dim: 2, Lists: 4, Probes: 1}); err != nil {
+		t.Fatal(err)
+	}
+	report, err := db.Check("points")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.IsHealthy() {
+		t.Fatalf("Check: %+v", report)
+	}
+
+	query := db.Query("points").Nearest("vector", []float64{101, 99}, 3, kv2doc.L2)
+	explain := query.Explain()
+	if explain.Plan.Access != "index" || !strings.HasPrefix(explain.Index.String(), "v/vector/") {
+		t.Errorf("Plan = %+v, want a scan of one vector list", explain.Plan)
+	}
+	docs, err := query.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, v := range docs {
+		got = append(got, v["vector"])
+	}
+	if want := []string{"[101,99]", "[100,100]", "[102,98]"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// 新写入的向量按已有的聚类中心建立索引
+	addDocs(t, db, "points", kv2doc.Doc{"group": "3", "vector": "[101,100]"})
+	docs, err = db.Query("points").Nearest("vector", []float64{101, 100}, 1, kv2doc.L2).List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 1 || docs[0]["vector"] != "[101,100]" {
+		t.Errorf("got %v, want the new vector", docs)
+	}
+}
+
+// 重新训练聚类中心期间，查询仍然使用旧的聚类中心及完整的旧倒排列表
+func TestNearestRetrain(t *testing.T) {
+	db, s := newTestDB(t)
+	centers := [][2]float64{{0, 0}, {100, 0}, {0, 100}, {100, 100}}
+	for i, c := range centers {
+		for j := 0; j < 20; j++ {
+			addDocs(t, db, "points", kv2doc.Doc{
+				"group":  fmt.Sprint(i),
+				"vector": fmt.Sprintf("[%g,%g]", c[0]+float64(j%5), c[1]-float64(j/5)),
+			})
+		}
+	}
+	if err := db.Define("points", kv2doc.Field{Name: "vector", Type: kv2doc.Vector, Dim: 2, Lists: 4, Probes: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 3; i++ {
+			if err := db.Reindex("points"); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for running := true; running; {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			running = false
+		default:
+		}
+		docs, err := db.Query("points").Nearest("vector", []float64{101, 99}, 1, kv2doc.L2).List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(docs) != 1 || docs[0]["vector"] != "[101,99]" {
+			t.Fatalf("got %v during Reindex, want [101,99]", docs)
+		}
+	}
+
+	// 训练了 4 次（Define 及 3 次 Reindex），只保留最后一批倒排列表
+	var lists []string
+	err := s.ScanKV("points", "v/", func(key string, value []byte) bool {
+		lists = append(lists, key)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lists) != 80 {
+		t.Errorf("got %d vector index keys, want 80", len(lists))
+	}
+	for _, v := range lists {
+		if !strings.HasPrefix(v, "v/vector/4-") {
+			t.Fatalf("vector index key %s is not from the last training", v)
+		}
+	}
+	report, err := db.Check("points")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.IsHealthy() {
+		t.Errorf("Check: %+v", report)
+	}
+}